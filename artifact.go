@@ -11,8 +11,9 @@ const BuilderId = "martezr.vsphere-iso"
 // Artifact is the result of running the vsphere-iso builder, namely a set
 // of files associated with the resulting machine.
 type Artifact struct {
-	Name string
-	VM   *object.VirtualMachine
+	Name      string
+	VM        *object.VirtualMachine
+	Datastore string
 }
 
 // BuilderId returns the builder ID.
@@ -37,6 +38,9 @@ func (a *Artifact) String() string {
 
 // State returns specific details from the artifact.
 func (a *Artifact) State(name string) interface{} {
+	if name == "datastore" {
+		return a.Datastore
+	}
 	return nil
 }
 
@@ -40,28 +40,62 @@ func (b *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packe
 		&StepConnect{
 			config: &b.config.ConnectConfig,
 		},
-		&StepCreateVM{
+		&StepPreflight{
+			config: &b.config.CreateConfig,
+		},
+		&StepCheckPrivileges{
+			config: b.config,
+		},
+		&StepCreateResourcePool{
 			config: &b.config.CreateConfig,
 		},
+		&StepCreateVM{
+			config:       &b.config.CreateConfig,
+			hardware:     &b.config.HardwareConfig,
+			configParams: b.config.ConfigParams,
+		},
 		&StepConfigureHardware{
-			config: &b.config.HardwareConfig,
+			config:       &b.config.HardwareConfig,
+			configParams: b.config.ConfigParams,
+			createConfig: &b.config.CreateConfig,
 		},
 	)
 
-	if b.config.Comm.Type != "none" {
+	if b.config.Comm.Type == "vmware-tools" {
+		steps = append(steps,
+			&StepRun{
+				toolsOnly: true,
+			},
+			&StepConnectTools{
+				config: &b.config.ToolsConfig,
+			},
+			&common.StepProvision{},
+			&StepShutdown{
+				config: &b.config.ShutdownConfig,
+			},
+		)
+	} else if b.config.Comm.Type != "none" {
 		steps = append(steps,
 			&StepRun{},
+			&StepConnectSSHAgent{
+				agentAuth: b.config.Comm.Type == "ssh" && b.config.Comm.SSHAgentAuth,
+			},
 			&communicator.StepConnect{
 				Config:    &b.config.Comm,
 				Host:      commHost,
 				SSHConfig: sshConfig,
 			},
 			&common.StepProvision{},
-			&StepShutdown{},
+			&StepShutdown{
+				config: &b.config.ShutdownConfig,
+			},
 		)
 	}
 
 	steps = append(steps,
+		&StepRemoveExtraConfig{
+			keys: append(b.config.GuestInfoConfig.Keys(), b.config.RemoveConfigParams...),
+		},
 		&StepCreateSnapshot{
 			createSnapshot: b.config.CreateSnapshot,
 		},
@@ -89,8 +123,9 @@ func (b *Builder) Run(ui packer.Ui, hook packer.Hook, cache packer.Cache) (packe
 	}
 
 	artifact := &Artifact{
-		Name: b.config.VMName,
-		VM:   state.Get("vm").(*object.VirtualMachine),
+		Name:      b.config.VMName,
+		VM:        state.Get("vm").(*object.VirtualMachine),
+		Datastore: state.Get("datastore").(string),
 	}
 	return artifact, nil
 }
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/packer/packer"
+	"github.com/vmware/govmomi/guest"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// ToolsConfig holds the guest credentials used by the vmware-tools communicator.
+type ToolsConfig struct {
+	ToolsUsername       string `mapstructure:"tools_username"`
+	ToolsPassword       string `mapstructure:"tools_password"`
+	ToolsCommandTimeout string `mapstructure:"tools_command_timeout"`
+
+	commandTimeout time.Duration
+}
+
+// Prepare the vmware-tools communicator configuration
+func (c *ToolsConfig) Prepare() []error {
+	var errs []error
+
+	if c.ToolsUsername == "" {
+		errs = append(errs, fmt.Errorf("'tools_username' is required for the vmware-tools communicator"))
+	}
+	if c.ToolsPassword == "" {
+		errs = append(errs, fmt.Errorf("'tools_password' is required for the vmware-tools communicator"))
+	}
+
+	if c.ToolsCommandTimeout == "" {
+		c.ToolsCommandTimeout = "1h"
+	}
+	if timeout, err := time.ParseDuration(c.ToolsCommandTimeout); err != nil || timeout <= 0 {
+		errs = append(errs, fmt.Errorf("'tools_command_timeout' must be a positive duration such as '30m', got '%v'", c.ToolsCommandTimeout))
+	} else {
+		c.commandTimeout = timeout
+	}
+
+	return errs
+}
+
+// ToolsCommunicator runs commands and transfers files through the vSphere
+// guest operations API, so the guest does not need to be reachable over the network.
+type ToolsCommunicator struct {
+	ctx     context.Context
+	client  *vim25.Client
+	ops     *guest.OperationsManager
+	auth    types.BaseGuestAuthentication
+	windows bool
+	timeout time.Duration
+}
+
+const (
+	processPollInitialDelay = 500 * time.Millisecond
+	processPollMaxDelay     = 5 * time.Second
+)
+
+// NewToolsCommunicator creates a communicator for the given VM
+func NewToolsCommunicator(d *Driver, vm *object.VirtualMachine, config *ToolsConfig) (*ToolsCommunicator, error) {
+	windows, err := d.IsWindowsGuest(vm)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &ToolsCommunicator{
+		ctx:    d.ctx,
+		client: d.client.Client,
+		ops:    guest.NewOperationsManager(d.client.Client, vm.Reference()),
+		auth: &types.NamePasswordAuthentication{
+			Username: config.ToolsUsername,
+			Password: config.ToolsPassword,
+		},
+		windows: windows,
+		timeout: config.commandTimeout,
+	}
+	return c, nil
+}
+
+// Start runs the command in the guest and reports its output once the process exits
+func (c *ToolsCommunicator) Start(cmd *packer.RemoteCmd) error {
+	// Guest processes cannot be given input, fail rather than run the command without it
+	if cmd.Stdin != nil {
+		return fmt.Errorf("vmware-tools communicator does not support stdin, cannot run: %s", cmd.Command)
+	}
+
+	pm, err := c.ops.ProcessManager(c.ctx)
+	if err != nil {
+		return err
+	}
+
+	stdout := c.tempPath("stdout")
+	stderr := c.tempPath("stderr")
+
+	pid, err := pm.StartProgram(c.ctx, c.auth, c.programSpec(cmd.Command, stdout, stderr))
+	if err != nil {
+		return err
+	}
+	log.Printf("Started guest process %v: %s", pid, cmd.Command)
+
+	go func() {
+		status, err := c.waitForProcess(pm, pid)
+		if err != nil {
+			log.Printf("Error waiting for guest process %v: %s", pid, err)
+			status = 1
+		}
+
+		c.collectOutput(stdout, cmd.Stdout)
+		c.collectOutput(stderr, cmd.Stderr)
+
+		cmd.SetExited(status)
+	}()
+
+	return nil
+}
+
+// Upload copies the data to the given path in the guest
+func (c *ToolsCommunicator) Upload(dst string, r io.Reader, fi *os.FileInfo) error {
+	fm, err := c.ops.FileManager(c.ctx)
+	if err != nil {
+		return err
+	}
+
+	var size int64
+	if fi != nil {
+		size = (*fi).Size()
+	} else {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		size = int64(len(data))
+		r = bytes.NewReader(data)
+	}
+
+	s, err := fm.InitiateFileTransferToGuest(c.ctx, c.auth, dst, &types.GuestFileAttributes{}, size, true)
+	if err != nil {
+		return err
+	}
+	u, err := c.client.ParseURL(s)
+	if err != nil {
+		return err
+	}
+
+	p := soap.DefaultUpload
+	p.ContentLength = size
+	return c.client.Upload(c.ctx, r, u, &p)
+}
+
+// UploadDir copies a local directory into the guest
+func (c *ToolsCommunicator) UploadDir(dst string, src string, exclude []string) error {
+	fm, err := c.ops.FileManager(c.ctx)
+	if err != nil {
+		return err
+	}
+
+	// Same semantics as the other communicators: without a trailing slash
+	// the directory itself is copied, not only its contents.
+	if !strings.HasSuffix(src, "/") {
+		dst = c.join(dst, filepath.Base(src))
+	}
+
+	return filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		if rel != "." && isExcluded(filepath.ToSlash(rel), exclude) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target := dst
+		if rel != "." {
+			target = c.join(dst, filepath.ToSlash(rel))
+		}
+
+		if info.IsDir() {
+			err := fm.MakeDirectory(c.ctx, c.auth, target, true)
+			if err != nil && !isFileAlreadyExists(err) {
+				return err
+			}
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return c.Upload(target, f, &info)
+	})
+}
+
+// Download copies a file from the guest into the writer
+func (c *ToolsCommunicator) Download(src string, w io.Writer) error {
+	fm, err := c.ops.FileManager(c.ctx)
+	if err != nil {
+		return err
+	}
+
+	info, err := fm.InitiateFileTransferFromGuest(c.ctx, c.auth, src)
+	if err != nil {
+		return err
+	}
+	u, err := c.client.ParseURL(info.Url)
+	if err != nil {
+		return err
+	}
+
+	r, _, err := c.client.Download(c.ctx, u, &soap.DefaultDownload)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// DownloadDir copies a guest directory to the local machine
+func (c *ToolsCommunicator) DownloadDir(src string, dst string, exclude []string) error {
+	return c.downloadDir(src, dst, "", exclude)
+}
+
+// downloadDir copies the guest directory src, at the path rel below the
+// directory being downloaded, skipping the excluded entries
+func (c *ToolsCommunicator) downloadDir(src string, dst string, rel string, exclude []string) error {
+	fm, err := c.ops.FileManager(c.ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+
+	var offset int32
+	for {
+		list, err := fm.ListFiles(c.ctx, c.auth, src, offset, 100, "")
+		if err != nil {
+			return err
+		}
+
+		for _, file := range list.Files {
+			if file.Path == "." || file.Path == ".." {
+				continue
+			}
+
+			entry := path.Join(rel, file.Path)
+			if isExcluded(entry, exclude) {
+				continue
+			}
+
+			remote := c.join(src, file.Path)
+			local := filepath.Join(dst, file.Path)
+
+			if file.Type == string(types.GuestFileTypeDirectory) {
+				if err := c.downloadDir(remote, local, entry, exclude); err != nil {
+					return err
+				}
+				continue
+			}
+
+			f, err := os.Create(local)
+			if err != nil {
+				return err
+			}
+			err = c.Download(remote, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+
+		offset += int32(len(list.Files))
+		if list.Remaining == 0 {
+			return nil
+		}
+	}
+}
+
+func (c *ToolsCommunicator) programSpec(command string, stdout string, stderr string) *types.GuestProgramSpec {
+	if c.windows {
+		// With /S, cmd.exe removes only the outer quotes and keeps the quotes of the command
+		return &types.GuestProgramSpec{
+			ProgramPath: `C:\Windows\System32\cmd.exe`,
+			Arguments:   fmt.Sprintf(`/S /C "%s >%s 2>%s"`, command, stdout, stderr),
+		}
+	}
+
+	return &types.GuestProgramSpec{
+		ProgramPath: "/bin/sh",
+		Arguments:   fmt.Sprintf("-c %s >%s 2>%s", shellQuote(command), stdout, stderr),
+	}
+}
+
+func (c *ToolsCommunicator) waitForProcess(pm *guest.ProcessManager, pid int64) (int, error) {
+	timeout := time.After(c.timeout)
+	delay := processPollInitialDelay
+
+	for {
+		procs, err := pm.ListProcesses(c.ctx, c.auth, []int64{pid})
+		if err != nil {
+			return 0, err
+		}
+		if len(procs) == 0 {
+			return 0, fmt.Errorf("Guest process %v not found", pid)
+		}
+		if procs[0].EndTime != nil {
+			return int(procs[0].ExitCode), nil
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-timeout:
+			if err := pm.TerminateProcess(c.ctx, c.auth, pid); err != nil {
+				log.Printf("Error terminating guest process %v: %s", pid, err)
+			}
+			return 0, fmt.Errorf("Guest process %v did not exit within %v", pid, c.timeout)
+		case <-c.ctx.Done():
+			return 0, c.ctx.Err()
+		}
+
+		// Short commands finish quickly, long ones do not need frequent polling
+		delay *= 2
+		if delay > processPollMaxDelay {
+			delay = processPollMaxDelay
+		}
+	}
+}
+
+// isExcluded reports whether the slash separated path of an entry, relative to
+// the directory being copied, or its base name matches one of the exclude patterns
+func isExcluded(rel string, exclude []string) bool {
+	for _, pattern := range exclude {
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// collectOutput copies a redirected output file to the writer and removes it from the guest
+func (c *ToolsCommunicator) collectOutput(src string, w io.Writer) {
+	if w == nil {
+		w = ioutil.Discard
+	}
+	if err := c.Download(src, w); err != nil {
+		log.Printf("Error downloading %s from guest: %s", src, err)
+	}
+
+	fm, err := c.ops.FileManager(c.ctx)
+	if err != nil {
+		return
+	}
+	if err := fm.DeleteFile(c.ctx, c.auth, src); err != nil {
+		log.Printf("Error removing %s from guest: %s", src, err)
+	}
+}
+
+func (c *ToolsCommunicator) tempPath(name string) string {
+	file := fmt.Sprintf("packer-%v.%s", time.Now().UnixNano(), name)
+	if c.windows {
+		return `C:\Windows\Temp\` + file
+	}
+	return path.Join("/tmp", file)
+}
+
+func (c *ToolsCommunicator) join(elem ...string) string {
+	if c.windows {
+		return strings.Join(elem, `\`)
+	}
+	return path.Join(elem...)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func isFileAlreadyExists(err error) bool {
+	if !soap.IsSoapFault(err) {
+		return false
+	}
+	_, ok := soap.ToSoapFault(err).VimFault().(types.FileAlreadyExists)
+	return ok
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/packer/packer"
+)
+
+func TestIsExcluded(t *testing.T) {
+	exclude := []string{"*.log", "cache", "tmp/*"}
+
+	tests := []struct {
+		path     string
+		excluded bool
+	}{
+		{"install.log", true},
+		{"logs/install.log", true},
+		{"cache", true},
+		{"var/cache", true},
+		{"tmp/file", true},
+		{"tmp", false},
+		{"scripts/setup.sh", false},
+	}
+	for _, test := range tests {
+		if excluded := isExcluded(test.path, exclude); excluded != test.excluded {
+			t.Errorf("%v: expected excluded to be %v, got %v", test.path, test.excluded, excluded)
+		}
+	}
+}
+
+func TestToolsCommunicatorStdin(t *testing.T) {
+	c := &ToolsCommunicator{}
+	cmd := &packer.RemoteCmd{Command: "cat", Stdin: strings.NewReader("input")}
+	if err := c.Start(cmd); err == nil {
+		t.Errorf("Commands with stdin should fail")
+	}
+}
+
+func TestWindowsProgramSpec(t *testing.T) {
+	c := &ToolsCommunicator{windows: true}
+	spec := c.programSpec(`"C:\Program Files\app.exe" /quiet`, `C:\out`, `C:\err`)
+
+	expected := `/S /C ""C:\Program Files\app.exe" /quiet >C:\out 2>C:\err"`
+	if spec.Arguments != expected {
+		t.Errorf("Expected arguments %v, got %v", expected, spec.Arguments)
+	}
+}
@@ -14,6 +14,10 @@ type Config struct {
 	ConnectConfig       `mapstructure:",squash"`
 	CreateConfig        `mapstructure:",squash"`
 	HardwareConfig      `mapstructure:",squash"`
+	ConfigParamsConfig  `mapstructure:",squash"`
+	ToolsConfig         `mapstructure:",squash"`
+	SSHConfig           `mapstructure:",squash"`
+	ShutdownConfig      `mapstructure:",squash"`
 	Comm                communicator.Config `mapstructure:",squash"`
 	CreateSnapshot      bool                `mapstructure:"create_snapshot"`
 	ConvertToTemplate   bool                `mapstructure:"convert_to_template"`
@@ -24,13 +28,19 @@ type Config struct {
 // NewConfig parses and validates the given config.
 func NewConfig(raws ...interface{}) (*Config, []string, error) {
 	c := new(Config)
+
+	raws, warnings, legacyErrs := migrateLegacyHardwareKeys(raws)
+	if len(legacyErrs) > 0 {
+		return nil, warnings, &packer.MultiError{Errors: legacyErrs}
+	}
+
 	{
 		err := config.Decode(c, &config.DecodeOpts{
 			Interpolate:        true,
 			InterpolateContext: &c.ctx,
 		}, raws...)
 		if err != nil {
-			return nil, nil, err
+			return nil, warnings, err
 		}
 	}
 
@@ -38,11 +48,22 @@ func NewConfig(raws ...interface{}) (*Config, []string, error) {
 	errs = packer.MultiErrorAppend(errs, c.ConnectConfig.Prepare()...)
 	errs = packer.MultiErrorAppend(errs, c.CreateConfig.Prepare()...)
 	errs = packer.MultiErrorAppend(errs, c.HardwareConfig.Prepare()...)
-	errs = packer.MultiErrorAppend(errs, c.Comm.Prepare(&c.ctx)...)
+	errs = packer.MultiErrorAppend(errs, c.ConfigParamsConfig.Prepare()...)
+	errs = packer.MultiErrorAppend(errs, c.ShutdownConfig.Prepare()...)
+	if c.Comm.Type == "vmware-tools" {
+		errs = packer.MultiErrorAppend(errs, c.ToolsConfig.Prepare()...)
+	} else {
+		commErrs := c.Comm.Prepare(&c.ctx)
+		if c.SSHPrivateKeyPassphrase != "" {
+			commErrs = withoutPrivateKeyErrors(commErrs)
+		}
+		errs = packer.MultiErrorAppend(errs, commErrs...)
+		errs = packer.MultiErrorAppend(errs, c.SSHConfig.Prepare(&c.Comm)...)
+	}
 
 	if len(errs.Errors) > 0 {
-		return nil, nil, errs
+		return nil, warnings, errs
 	}
 
-	return c, nil, nil
+	return c, warnings, nil
 }
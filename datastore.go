@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Policies of datastore_selection
+const (
+	datastoreMostFreeSpace    = "most_free_space"
+	datastoreLeastProvisioned = "least_provisioned"
+)
+
+// datastoreCandidate is a datastore considered by datastore_selection
+type datastoreCandidate struct {
+	name        string
+	capacity    int64
+	freeSpace   int64
+	uncommitted int64
+}
+
+// provisioned returns the space used and promised to thin provisioned disks
+func (c datastoreCandidate) provisioned() int64 {
+	return c.capacity - c.freeSpace + c.uncommitted
+}
+
+// SelectDatastore picks the datastore of the VM among the datastores of the
+// target compute resource according to datastore_selection, skipping the
+// datastores in maintenance mode or inaccessible to the target host
+func (d *Driver) SelectDatastore(config *CreateConfig) (string, error) {
+	pool, err := d.finder.ResourcePoolOrDefault(d.ctx, config.ResourcePool)
+	if err != nil {
+		return "", err
+	}
+
+	var p mo.ResourcePool
+	err = pool.Properties(d.ctx, pool.Reference(), []string{"owner"}, &p)
+	if err != nil {
+		return "", err
+	}
+
+	var cr mo.ComputeResource
+	err = d.client.RetrieveOne(d.ctx, p.Owner, []string{"datastore"}, &cr)
+	if err != nil {
+		return "", err
+	}
+	if len(cr.Datastore) == 0 {
+		return "", fmt.Errorf("Compute resource of resource pool '%v' has no datastores", pool.InventoryPath)
+	}
+
+	var host *types.ManagedObjectReference
+	if config.Host != "" {
+		// A cluster given as host has no single host the datastore must be mounted on
+		if h, err := d.finder.HostSystem(d.ctx, config.Host); err == nil {
+			ref := h.Reference()
+			host = &ref
+		}
+	}
+
+	var datastores []mo.Datastore
+	pc := property.DefaultCollector(d.client.Client)
+	err = pc.Retrieve(d.ctx, cr.Datastore, []string{"name", "summary", "host"}, &datastores)
+	if err != nil {
+		return "", err
+	}
+
+	var candidates []datastoreCandidate
+	for _, ds := range datastores {
+		if !ds.Summary.Accessible {
+			continue
+		}
+		if ds.Summary.MaintenanceMode != "" && ds.Summary.MaintenanceMode != string(types.DatastoreSummaryMaintenanceModeStateNormal) {
+			continue
+		}
+		if host != nil && !mountedOn(ds, *host) {
+			continue
+		}
+		if config.datastoreNameRegexp != nil && !config.datastoreNameRegexp.MatchString(ds.Name) {
+			continue
+		}
+
+		candidates = append(candidates, datastoreCandidate{
+			name:        ds.Name,
+			capacity:    ds.Summary.Capacity,
+			freeSpace:   ds.Summary.FreeSpace,
+			uncommitted: ds.Summary.Uncommitted,
+		})
+	}
+
+	return selectDatastore(candidates, config.DatastoreSelection, config.diskBytes)
+}
+
+// selectDatastore returns the best candidate with room for the disk
+func selectDatastore(candidates []datastoreCandidate, policy string, diskBytes int64) (string, error) {
+	var fitting []datastoreCandidate
+	for _, c := range candidates {
+		if c.freeSpace >= diskBytes {
+			fitting = append(fitting, c)
+		}
+	}
+	if len(fitting) == 0 {
+		return "", fmt.Errorf("No datastore matching 'datastore_selection' has %v bytes free for the disk, %v datastores considered", diskBytes, len(candidates))
+	}
+
+	sort.SliceStable(fitting, func(i, j int) bool {
+		if policy == datastoreLeastProvisioned {
+			return fitting[i].provisioned() < fitting[j].provisioned()
+		}
+		return fitting[i].freeSpace > fitting[j].freeSpace
+	})
+	return fitting[0].name, nil
+}
+
+// mountedOn reports whether the datastore is mounted and accessible on the host
+func mountedOn(ds mo.Datastore, host types.ManagedObjectReference) bool {
+	for _, mount := range ds.Host {
+		if mount.Key != host {
+			continue
+		}
+		info := mount.MountInfo
+		return (info.Mounted == nil || *info.Mounted) && (info.Accessible == nil || *info.Accessible)
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestSelectDatastore(t *testing.T) {
+	candidates := []datastoreCandidate{
+		{name: "small", capacity: 100, freeSpace: 10},
+		{name: "full", capacity: 1000, freeSpace: 300, uncommitted: 600},
+		{name: "empty", capacity: 500, freeSpace: 200},
+	}
+
+	tests := []struct {
+		policy    string
+		diskBytes int64
+		expected  string
+	}{
+		{datastoreMostFreeSpace, 50, "full"},
+		{datastoreLeastProvisioned, 50, "empty"},
+		{datastoreLeastProvisioned, 250, "full"},
+	}
+	for _, test := range tests {
+		name, err := selectDatastore(candidates, test.policy, test.diskBytes)
+		if err != nil {
+			t.Errorf("%v with %v bytes: %s", test.policy, test.diskBytes, err)
+		} else if name != test.expected {
+			t.Errorf("%v with %v bytes: expected '%v', got '%v'", test.policy, test.diskBytes, test.expected, name)
+		}
+	}
+
+	if _, err := selectDatastore(candidates, datastoreMostFreeSpace, 400); err == nil {
+		t.Errorf("no datastore has 400 bytes free, an error is expected")
+	}
+}
@@ -2,56 +2,148 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"github.com/hashicorp/packer/packer"
 	"github.com/vmware/govmomi"
 	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/guest"
 	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/pbm"
+	"github.com/vmware/govmomi/property"
 	"github.com/vmware/govmomi/session"
 	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/soap"
 	"github.com/vmware/govmomi/vim25/types"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
 	"net/url"
+	"path"
+	"reflect"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 )
 
 // Driver stores all the configuration data
 type Driver struct {
-	ctx          context.Context
-	client       *govmomi.Client
-	finder       *find.Finder
-	datacenter   *object.Datacenter
-	ResourcePool *object.ResourcePool
+	ctx           context.Context
+	client        *govmomi.Client
+	finder        *find.Finder
+	datacenter    *object.Datacenter
+	ResourcePool  *object.ResourcePool
+	sessionCached bool
+	retryBudget   time.Duration
+	ui            packer.Ui
+	pbm           *pbm.Client
 }
 
 // NewDriver creates a new vSphere connection
 func NewDriver(config *ConnectConfig) (*Driver, error) {
 	ctx := context.TODO()
 
-	vcenterURL, err := url.Parse(fmt.Sprintf("https://%v/sdk", config.VCenterServer))
+	vcenterURL, err := parseVCenterURL(config.VCenterServer)
 	if err != nil {
 		return nil, err
 	}
 	credentials := url.UserPassword(config.Username, config.Password)
-	vcenterURL.User = credentials
+	if !config.usesTokenAuth() {
+		vcenterURL.User = credentials
+	}
 
 	soapClient := soap.NewClient(vcenterURL, config.InsecureConnection)
+	proxyURL, err := config.proxyURL()
+	if err != nil {
+		return nil, err
+	}
+	// The transport is used by the SOAP client as well as datastore and guest file transfers
+	transport := soapClient.Client.Transport.(*http.Transport)
+	if proxyURL != nil {
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	if config.CAFile != "" {
+		err = soapClient.SetRootCAs(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading 'ca_file': %s", err)
+		}
+	}
+	if config.VCenterThumbprint != "" {
+		// govmomi checks thumbprints in its own DialTLS, which net/http skips when
+		// connecting through a proxy, so the pin is verified during the handshake
+		soapClient.SetThumbprint(vcenterURL.Host, config.VCenterThumbprint)
+		tlsConfig := transport.TLSClientConfig
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = verifyThumbprint(tlsConfig, vcenterURL.Hostname(), config.VCenterThumbprint)
+	}
+
 	vimClient, err := vim25.NewClient(ctx, soapClient)
 	if err != nil {
+		if isCertificateError(err) {
+			return nil, certificateError(vcenterURL, transport.Proxy, err)
+		}
 		return nil, err
 	}
 
-	vimClient.RoundTripper = session.KeepAlive(vimClient.RoundTripper, 10*time.Minute)
 	client := &govmomi.Client{
 		Client:         vimClient,
 		SessionManager: session.NewManager(vimClient),
 	}
 
-	err = client.SessionManager.Login(ctx, credentials)
-	if err != nil {
-		return nil, err
+	// Sessions are shared with other builds through the cache, keyed by server and identity
+	var cacheFile string
+	sessionURL := *vcenterURL
+	sessionURL.User = nil
+	if config.PersistSession {
+		cacheFile = sessionCacheFile(config.SessionCacheDir, &sessionURL, config.sessionIdentity())
+	}
+
+	var d *Driver
+	login := func(ctx context.Context) error {
+		var err error
+		if config.usesTokenAuth() {
+			err = loginByToken(ctx, client, config)
+		} else {
+			err = client.SessionManager.Login(ctx, credentials)
+		}
+		if err != nil {
+			return err
+		}
+		// The storage policy client copies the session cookie when created
+		if d != nil {
+			d.pbm = nil
+		}
+		if cacheFile != "" {
+			if err := saveSession(cacheFile, soapClient, &sessionURL); err != nil {
+				log.Printf("Error writing session cache '%v': %s", cacheFile, err)
+			}
+		}
+		return nil
+	}
+
+	vimClient.RoundTripper = &reloginRoundTripper{
+		RoundTripper: session.KeepAlive(vimClient.RoundTripper, 10*time.Minute),
+		login:        login,
+	}
+
+	var userSession *types.UserSession
+	if cacheFile != "" && loadSession(cacheFile, soapClient, &sessionURL) {
+		userSession, err = client.SessionManager.UserSession(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if userSession == nil {
+		err = login(ctx)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	finder := find.NewFinder(client.Client, false)
@@ -61,17 +153,105 @@ func NewDriver(config *ConnectConfig) (*Driver, error) {
 	}
 	finder.SetDatacenter(datacenter)
 
-	d := Driver{
-		ctx:        ctx,
-		client:     client,
-		datacenter: datacenter,
-		finder:     finder,
+	d = &Driver{
+		ctx:           ctx,
+		client:        client,
+		datacenter:    datacenter,
+		finder:        finder,
+		sessionCached: cacheFile != "",
+		retryBudget:   config.retryBudget,
+	}
+	return d, nil
+}
+
+// Logout ends the vCenter session, unless it is cached for other builds
+func (d *Driver) Logout() error {
+	if d.sessionCached {
+		return nil
+	}
+	return d.client.SessionManager.Logout(d.ctx)
+}
+
+// verifyThumbprint returns a certificate verification accepting certificates
+// signed by a trusted CA for host, or matching the thumbprint
+func verifyThumbprint(tlsConfig *tls.Config, host string, thumbprint string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		var certs []*x509.Certificate
+		for _, raw := range rawCerts {
+			cert, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs = append(certs, cert)
+		}
+		if len(certs) == 0 {
+			return fmt.Errorf("Host %q presented no certificate", host)
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range certs[1:] {
+			intermediates.AddCert(cert)
+		}
+		opts := x509.VerifyOptions{
+			DNSName:       host,
+			Roots:         tlsConfig.RootCAs,
+			Intermediates: intermediates,
+		}
+		if _, err := certs[0].Verify(opts); err == nil {
+			return nil
+		}
+
+		if peer := soap.ThumbprintSHA1(certs[0]); peer != thumbprint {
+			return fmt.Errorf("Host %q thumbprint does not match %q", host, thumbprint)
+		}
+		return nil
 	}
-	return &d, nil
 }
 
+// isCertificateError reports whether the server certificate could not be verified
+func isCertificateError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	switch err.(type) {
+	case x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError:
+		return true
+	}
+	return strings.Contains(err.Error(), "thumbprint does not match")
+}
+
+// certificateError explains a failed certificate verification, including the server thumbprint
+func certificateError(u *url.URL, proxy func(*http.Request) (*url.URL, error), err error) error {
+	// The certificate is fetched through the same proxy as the SOAP client
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:           proxy,
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+		Timeout: 30 * time.Second,
+	}
+	target := *u
+	target.User = nil
+	res, headErr := client.Head(target.String())
+	if headErr != nil {
+		return fmt.Errorf("Cannot verify the certificate of %v: %s", u.Host, err)
+	}
+	res.Body.Close()
+	if res.TLS == nil || len(res.TLS.PeerCertificates) == 0 {
+		return fmt.Errorf("Cannot verify the certificate of %v: %s", u.Host, err)
+	}
+
+	thumbprint := soap.ThumbprintSHA1(res.TLS.PeerCertificates[0])
+	return fmt.Errorf("Cannot verify the certificate of %v: %s\n"+
+		"The server thumbprint is %v. Set 'vcenter_thumbprint' to it or 'ca_file' to the issuing CA to trust the server.",
+		u.Host, err, thumbprint)
+}
+
+// builderMarkerKey is the advanced setting marking the VMs created by this builder
+const builderMarkerKey = "packer.builderId"
+
 // CreateVM creates the VM
-func (d *Driver) CreateVM(config *CreateConfig) (*object.VirtualMachine, error) {
+func (d *Driver) CreateVM(config *CreateConfig, hardware *HardwareConfig, params map[string]string) (*object.VirtualMachine, error) {
 
 	var devices object.VirtualDeviceList
 	var err error
@@ -79,29 +259,63 @@ func (d *Driver) CreateVM(config *CreateConfig) (*object.VirtualMachine, error)
 	spec := &types.VirtualMachineConfigSpec{
 		Name:       config.VMName,
 		GuestId:    config.GuestOS,
-		NumCPUs:    int32(config.CPU),
-		MemoryMB:   int64(config.RAM),
+		NumCPUs:    hardware.CPUs,
+		MemoryMB:   hardware.RAM,
 		Annotation: config.Annotation,
 		Version:    config.HardwareVersion,
 	}
+	if hardware.CPUCores > 0 {
+		spec.NumCPUs = hardware.CPUs * hardware.CPUCores
+		spec.NumCoresPerSocket = hardware.CPUCores
+	}
 
-	// Storage configuration
-	var bytesRegexp = regexp.MustCompile(`^(?i)(\d+)([BKMGTPE]?)(ib|b)?$`)
-	m := bytesRegexp.FindStringSubmatch(config.Disk)
-	i, _ := strconv.ParseInt(m[1], 10, 64)
-	diskByteSize := i * 1024 * 1024 * 1024
+	guestInfo, err := config.GuestInfoConfig.ExtraConfig()
+	if err != nil {
+		return nil, err
+	}
+	spec.ExtraConfig = append(optionValues(params), guestInfo...)
+	spec.ExtraConfig = append(spec.ExtraConfig, &types.OptionValue{Key: builderMarkerKey, Value: BuilderId})
+
+	// Devices not set explicitly follow the recommendations for the guest OS
+	netadaptertype := config.NetworkAdapter
+	diskcontroller := config.DiskControllerType
+	cdromtype := config.CdromType
+	spec.Firmware = config.Firmware
 
+	if config.GuestOS != "" && (netadaptertype == "" || diskcontroller == "" || cdromtype == "" || spec.Firmware == "") {
+		guest, err := d.guestOSDescriptor(config)
+		if err != nil {
+			return nil, err
+		}
+		if guest != nil {
+			if netadaptertype == "" {
+				netadaptertype = deviceTypeName(object.EthernetCardTypes(), guest.RecommendedEthernetCard)
+			}
+			if diskcontroller == "" {
+				diskcontroller = deviceTypeName(object.SCSIControllerTypes(), guest.RecommendedDiskController)
+			}
+			if cdromtype == "" && strings.Contains(guest.RecommendedCdromController, "AHCI") {
+				cdromtype = "sata"
+			}
+			if spec.Firmware == "" {
+				spec.Firmware = guest.RecommendedFirmware
+			}
+			log.Printf("Devices for guest OS %v: network adapter '%v', disk controller '%v', CD-ROM controller '%v', firmware '%v'",
+				config.GuestOS, netadaptertype, diskcontroller, cdromtype, spec.Firmware)
+		}
+	}
+
+	// Storage configuration
 	data := config.IsoDatastore
 	datafile := config.IsoFile
 
-	devices, err = d.addStorage(nil, data, datafile, diskByteSize)
+	devices, err = d.addStorage(nil, data, datafile, config.diskBytes, diskcontroller, cdromtype)
 	if err != nil {
 		return nil, err
 	}
 
 	// Network configuration
 	networkname := config.Network
-	netadaptertype := config.NetworkAdapter
 	devices, err = d.addNetwork(devices, networkname, netadaptertype)
 	if err != nil {
 		return nil, err
@@ -112,23 +326,41 @@ func (d *Driver) CreateVM(config *CreateConfig) (*object.VirtualMachine, error)
 		return nil, err
 	}
 
+	// The disk follows the VM storage policy unless it has its own
+	spec.VmProfile = profileSpec(config.storagePolicyID)
+	for _, change := range deviceChange {
+		if _, ok := change.GetVirtualDeviceConfigSpec().Device.(*types.VirtualDisk); ok {
+			change.GetVirtualDeviceConfigSpec().Profile = profileSpec(config.diskPolicyID())
+		}
+	}
+
 	spec.DeviceChange = deviceChange
 
-	folder, err := d.finder.FolderOrDefault(d.ctx, fmt.Sprintf("/%v/vm/%v", d.datacenter.Name(), config.Folder))
+	folder, err := d.Folder(config.Folder, config.CreateFolder)
 	if err != nil {
 		return nil, err
 	}
 
 	var relocateSpec types.VirtualMachineRelocateSpec
 
-	pool, err := d.finder.ResourcePoolOrDefault(d.ctx, config.ResourcePool)
-	if err != nil {
-		return nil, err
+	pool := d.ResourcePool
+	if pool == nil {
+		pool, err = d.finder.ResourcePoolOrDefault(d.ctx, config.ResourcePool)
+		if err != nil {
+			return nil, err
+		}
 	}
 	poolRef := pool.Reference()
 	relocateSpec.Pool = &poolRef
 
+	if config.DatastoreCluster != "" {
+		return d.createVMWithStorageDRS(spec, folder, pool, config.DatastoreCluster)
+	}
+
 	datastore, err := d.finder.Datastore(d.ctx, config.Datastore)
+	if err != nil {
+		return nil, err
+	}
 	datastoreRef := datastore.Reference()
 	relocateSpec.Datastore = &datastoreRef
 
@@ -136,62 +368,723 @@ func (d *Driver) CreateVM(config *CreateConfig) (*object.VirtualMachine, error)
 		VmPathName: fmt.Sprintf("[%s]", datastore.Name()),
 	}
 
-	task, err := folder.CreateVM(d.ctx, *spec, pool, nil)
+	info, err := d.runTask("Creating VM", func() (*object.Task, error) {
+		return folder.CreateVM(d.ctx, *spec, pool, nil)
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	info, err := task.WaitForResult(d.ctx, nil)
+	vm := object.NewVirtualMachine(d.client.Client, info.Result.(types.ManagedObjectReference))
+	return vm, nil
+}
+
+// createVMWithStorageDRS asks Storage DRS where to place the VM and its disk
+// in a datastore cluster and creates the VM by applying the recommendation
+func (d *Driver) createVMWithStorageDRS(spec *types.VirtualMachineConfigSpec, folder *object.Folder, pool *object.ResourcePool, clusterName string) (*object.VirtualMachine, error) {
+	pod, err := d.finder.DatastoreCluster(d.ctx, clusterName)
 	if err != nil {
 		return nil, err
 	}
+	podRef := pod.Reference()
 
-	vm := object.NewVirtualMachine(d.client.Client, info.Result.(types.ManagedObjectReference))
-	return vm, nil
+	selection := types.StorageDrsPodSelectionSpec{StoragePod: &podRef}
+	for _, change := range spec.DeviceChange {
+		disk, ok := change.GetVirtualDeviceConfigSpec().Device.(*types.VirtualDisk)
+		if !ok {
+			continue
+		}
+		selection.InitialVmConfig = append(selection.InitialVmConfig, types.VmPodConfigForPlacement{
+			StoragePod: podRef,
+			Disk:       []types.PodDiskLocator{{DiskId: disk.Key, DiskBackingInfo: disk.Backing}},
+		})
+	}
+
+	// Storage DRS chooses the datastore of the VM files as well
+	spec.Files = &types.VirtualMachineFileInfo{}
+
+	folderRef := folder.Reference()
+	poolRef := pool.Reference()
+	placement := types.StoragePlacementSpec{
+		Type:             string(types.StoragePlacementSpecPlacementTypeCreate),
+		PodSelectionSpec: selection,
+		ConfigSpec:       spec,
+		Folder:           &folderRef,
+		ResourcePool:     &poolRef,
+	}
+
+	srm := object.NewStorageResourceManager(d.client.Client)
+	result, err := srm.RecommendDatastores(d.ctx, placement)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Recommendations) == 0 {
+		var reasons []string
+		if result.DrsFault != nil {
+			for _, byVM := range result.DrsFault.FaultsByVm {
+				for _, fault := range byVM.GetClusterDrsFaultsFaultsByVm().Fault {
+					reasons = append(reasons, fault.LocalizedMessage)
+				}
+			}
+		}
+		if len(reasons) > 0 {
+			return nil, fmt.Errorf("Storage DRS cannot place the VM in datastore cluster '%v': %v", clusterName, strings.Join(reasons, "; "))
+		}
+		return nil, fmt.Errorf("Storage DRS has no recommendation for datastore cluster '%v'", clusterName)
+	}
+
+	key := result.Recommendations[0].Key
+	info, err := d.runTask("Creating VM", func() (*object.Task, error) {
+		return srm.ApplyStorageDrsRecommendation(d.ctx, []string{key})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	applied, ok := info.Result.(types.ApplyStorageRecommendationResult)
+	if !ok || applied.Vm == nil {
+		return nil, fmt.Errorf("Storage DRS did not return the created VM")
+	}
+	return object.NewVirtualMachine(d.client.Client, *applied.Vm), nil
 }
 
-// DestroyVM destroys the VM
-func (d *Driver) DestroyVM(vm *object.VirtualMachine) error {
-	task, err := vm.Destroy(d.ctx)
+// VMDatastore returns the name of the datastore holding the VM files
+func (d *Driver) VMDatastore(vm *object.VirtualMachine) (string, error) {
+	var mvm mo.VirtualMachine
+	err := vm.Properties(d.ctx, vm.Reference(), []string{"config.files.vmPathName"}, &mvm)
+	if err != nil {
+		return "", err
+	}
+	if mvm.Config == nil {
+		return "", fmt.Errorf("Cannot read the configuration of VM '%v'", vm.Reference().Value)
+	}
+
+	var p object.DatastorePath
+	if !p.FromString(mvm.Config.Files.VmPathName) {
+		return "", fmt.Errorf("Invalid VM path '%v'", mvm.Config.Files.VmPathName)
+	}
+	return p.Datastore, nil
+}
+
+// Preflight resolves every inventory object the VM creation depends on and
+// returns all problems found, so nothing is created when one of them is missing
+func (d *Driver) Preflight(config *CreateConfig) []error {
+	var errs []error
+
+	folder, err := d.Folder(config.Folder, false)
+	if err != nil {
+		// A missing folder is created together with the VM when create_folder is set
+		if _, missing := err.(*find.NotFoundError); !missing || !config.CreateFolder {
+			errs = append(errs, fmt.Errorf("Folder '%v': %s", config.Folder, err))
+		}
+	}
+
+	if _, err := d.finder.ResourcePoolOrDefault(d.ctx, config.ResourcePool); err != nil {
+		errs = append(errs, fmt.Errorf("Resource pool '%v': %s", config.ResourcePool, err))
+	}
+
+	if config.Cluster != "" {
+		if _, err := d.finder.ClusterComputeResource(d.ctx, config.Cluster); err != nil {
+			errs = append(errs, fmt.Errorf("Cluster '%v': %s", config.Cluster, err))
+		}
+	}
+
+	if config.Host != "" {
+		if _, err := d.finder.HostSystem(d.ctx, config.Host); err != nil {
+			// The host may also be a cluster
+			if _, cerr := d.finder.ClusterComputeResource(d.ctx, config.Host); cerr != nil {
+				errs = append(errs, fmt.Errorf("Host '%v': %s", config.Host, err))
+			}
+		}
+	}
+
+	if config.DatastoreCluster != "" {
+		pod, err := d.finder.DatastoreCluster(d.ctx, config.DatastoreCluster)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Datastore cluster '%v': %s", config.DatastoreCluster, err))
+		} else {
+			var sp mo.StoragePod
+			err := pod.Properties(d.ctx, pod.Reference(), []string{"summary"}, &sp)
+			if err != nil {
+				errs = append(errs, err)
+			} else if sp.Summary != nil && sp.Summary.FreeSpace < config.diskBytes {
+				errs = append(errs, fmt.Errorf("Datastore cluster '%v' has %v bytes free, the disk requires %v bytes", config.DatastoreCluster, sp.Summary.FreeSpace, config.diskBytes))
+			}
+		}
+	} else if datastore, err := d.finder.Datastore(d.ctx, config.Datastore); err != nil {
+		errs = append(errs, fmt.Errorf("Datastore '%v': %s", config.Datastore, err))
+	} else {
+		var ds mo.Datastore
+		err := datastore.Properties(d.ctx, datastore.Reference(), []string{"summary"}, &ds)
+		if err != nil {
+			errs = append(errs, err)
+		} else if ds.Summary.FreeSpace < config.diskBytes {
+			errs = append(errs, fmt.Errorf("Datastore '%v' has %v bytes free, the disk requires %v bytes", datastore.Name(), ds.Summary.FreeSpace, config.diskBytes))
+		}
+	}
+
+	if _, err := d.finder.Network(d.ctx, config.Network); err != nil {
+		errs = append(errs, fmt.Errorf("Network '%v': %s", config.Network, err))
+	}
+
+	isoDatastore, err := d.finder.Datastore(d.ctx, config.IsoDatastore)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("ISO datastore '%v': %s", config.IsoDatastore, err))
+	} else if _, err := isoDatastore.Stat(d.ctx, config.IsoFile); err != nil {
+		errs = append(errs, fmt.Errorf("ISO file '%v': %s", isoDatastore.Path(config.IsoFile), err))
+	}
+
+	if folder != nil {
+		vm, err := d.finder.VirtualMachine(d.ctx, path.Join(folder.InventoryPath, config.VMName))
+		if err == nil {
+			switch config.VMNameCollision {
+			case vmNameAppendTimestamp:
+				config.VMName = fmt.Sprintf("%v-%v", config.VMName, time.Now().Format("20060102150405"))
+			case vmNameOverwrite:
+				// The VM is destroyed when the VM is created, once every check passed
+				owned, err := d.CreatedByBuilder(vm)
+				if err != nil {
+					errs = append(errs, err)
+				} else if !owned {
+					errs = append(errs, fmt.Errorf("VM '%v' in folder '%v' has no '%v' marker of this builder, refusing to overwrite it", config.VMName, builderMarkerKey, folder.InventoryPath))
+				}
+			default:
+				errs = append(errs, fmt.Errorf("VM '%v' already exists in folder '%v', set 'force' to overwrite it", config.VMName, folder.InventoryPath))
+			}
+		} else if _, ok := err.(*find.NotFoundError); !ok {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// ValidateGuest checks guest_os_type and hardware_version against the values
+// supported by the target compute resource, and defaults hardware_version to
+// the newest supported version when unset
+func (d *Driver) ValidateGuest(config *CreateConfig) []error {
+	var errs []error
+
+	browser, err := d.environmentBrowser(config.ResourcePool)
+	if err != nil {
+		return []error{err}
+	}
+
+	versions, err := d.hardwareVersions(browser)
+	if err != nil {
+		return []error{err}
+	}
+
+	if config.HardwareVersion == "" {
+		config.HardwareVersion = newestHardwareVersion(versions)
+	} else if !containsString(versions, config.HardwareVersion) {
+		errs = append(errs, unsupportedValueError("hardware_version", config.HardwareVersion, versions))
+		return errs
+	}
+
+	option, err := d.configOption(browser, config.HardwareVersion)
+	if err != nil {
+		return append(errs, err)
+	}
+
+	if config.GuestOS != "" {
+		var ids []string
+		for _, guest := range option.GuestOSDescriptor {
+			ids = append(ids, guest.Id)
+		}
+		if !containsString(ids, config.GuestOS) {
+			errs = append(errs, unsupportedValueError("guest_os_type", config.GuestOS, ids))
+		}
+	}
+
+	return errs
+}
+
+// environmentBrowser returns the EnvironmentBrowser of the compute resource owning the resource pool
+func (d *Driver) environmentBrowser(resourcePool string) (types.ManagedObjectReference, error) {
+	var browser types.ManagedObjectReference
+
+	pool, err := d.finder.ResourcePoolOrDefault(d.ctx, resourcePool)
+	if err != nil {
+		return browser, err
+	}
+
+	var p mo.ResourcePool
+	err = pool.Properties(d.ctx, pool.Reference(), []string{"owner"}, &p)
+	if err != nil {
+		return browser, err
+	}
+
+	var cr mo.ComputeResource
+	err = d.client.RetrieveOne(d.ctx, p.Owner, []string{"environmentBrowser"}, &cr)
+	if err != nil {
+		return browser, err
+	}
+	if cr.EnvironmentBrowser == nil {
+		return browser, fmt.Errorf("Compute resource of resource pool '%v' has no environment browser", pool.InventoryPath)
+	}
+
+	return *cr.EnvironmentBrowser, nil
+}
+
+// hardwareVersions returns the hardware versions VMs can be created with
+func (d *Driver) hardwareVersions(browser types.ManagedObjectReference) ([]string, error) {
+	req := types.QueryConfigOptionDescriptor{This: browser}
+	res, err := methods.QueryConfigOptionDescriptor(d.ctx, d.client.Client, &req)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []string
+	for _, desc := range res.Returnval {
+		if desc.CreateSupported != nil && !*desc.CreateSupported {
+			continue
+		}
+		versions = append(versions, desc.Key)
+	}
+	return versions, nil
+}
+
+// configOption returns the VM configuration options of a hardware version
+func (d *Driver) configOption(browser types.ManagedObjectReference, version string) (*types.VirtualMachineConfigOption, error) {
+	req := types.QueryConfigOption{This: browser, Key: version}
+	res, err := methods.QueryConfigOption(d.ctx, d.client.Client, &req)
+	if err != nil {
+		return nil, err
+	}
+	if res.Returnval == nil {
+		return nil, fmt.Errorf("No configuration options for hardware version '%v'", version)
+	}
+	return res.Returnval, nil
+}
+
+// guestOSDescriptor returns the descriptor of the configured guest OS, or nil if the compute resource does not know it
+func (d *Driver) guestOSDescriptor(config *CreateConfig) (*types.GuestOsDescriptor, error) {
+	browser, err := d.environmentBrowser(config.ResourcePool)
+	if err != nil {
+		return nil, err
+	}
+
+	option, err := d.configOption(browser, config.HardwareVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range option.GuestOSDescriptor {
+		if option.GuestOSDescriptor[i].Id == config.GuestOS {
+			return &option.GuestOSDescriptor[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// deviceTypeName maps a device class name such as VirtualVmxnet3 to the type name used in the config
+func deviceTypeName(list object.VirtualDeviceList, class string) string {
+	for _, device := range list {
+		if reflect.TypeOf(device).Elem().Name() == class {
+			return deviceType(list, device)
+		}
+	}
+	return ""
+}
+
+// deviceNameRegexp extracts the type name of a device from its class name, as govmomi does
+var deviceNameRegexp = regexp.MustCompile(`(?:Virtual)?(?:Machine)?(\w+?)(?:Card|EthernetCard|Device|Controller)?$`)
+
+// deviceType returns the type name of a device accepted by CreateEthernetCard and
+// CreateSCSIController, e.g. vmxnet3 for VirtualVmxnet3 or pvscsi for ParaVirtualSCSIController
+func deviceType(list object.VirtualDeviceList, device types.BaseVirtualDevice) string {
+	// Type names every network adapter "ethernet"
+	if _, ok := device.(types.BaseVirtualEthernetCard); ok {
+		m := deviceNameRegexp.FindStringSubmatch(reflect.TypeOf(device).Elem().Name())
+		return strings.ToLower(m[1])
+	}
+	return list.Type(device)
+}
+
+// newestHardwareVersion picks the highest vmx-NN version
+func newestHardwareVersion(versions []string) string {
+	var newest string
+	var newestNumber int
+	for _, v := range versions {
+		n, err := strconv.Atoi(strings.TrimPrefix(v, "vmx-"))
+		if err != nil {
+			continue
+		}
+		if n > newestNumber {
+			newest, newestNumber = v, n
+		}
+	}
+	return newest
+}
+
+func unsupportedValueError(key string, value string, supported []string) error {
+	if matches := closestMatches(value, supported); len(matches) > 0 {
+		return fmt.Errorf("Unsupported '%v' '%v', did you mean %v?", key, value, strings.Join(matches, ", "))
+	}
+	return fmt.Errorf("Unsupported '%v' '%v', supported values are: %v", key, value, strings.Join(supported, ", "))
+}
+
+func containsString(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// privilegeCheck lists the privileges required on an inventory object
+type privilegeCheck struct {
+	name       string
+	entity     types.ManagedObjectReference
+	privileges []string
+}
+
+// CheckPrivileges verifies that the session user holds the privileges needed on
+// every target object and returns one error per object with missing privileges
+func (d *Driver) CheckPrivileges(config *CreateConfig, vmPrivileges []string) ([]error, error) {
+	var checks []privilegeCheck
+
+	if folderPath, err := d.folderPath(config.Folder); err == nil {
+		if folder, err := d.existingFolder(folderPath); err == nil {
+			// The VM does not exist yet, its privileges are inherited from the folder
+			privileges := append([]string{"VirtualMachine.Inventory.Create", "VirtualMachine.Inventory.Delete"}, vmPrivileges...)
+			if folder.InventoryPath != folderPath {
+				// Missing folders are created in their nearest existing parent
+				privileges = append(privileges, "Folder.Create")
+			}
+			checks = append(checks, privilegeCheck{
+				name:       "folder '" + folder.InventoryPath + "'",
+				entity:     folder.Reference(),
+				privileges: privileges,
+			})
+		}
+	}
+	if pool, err := d.finder.ResourcePoolOrDefault(d.ctx, config.ResourcePool); err == nil {
+		privileges := []string{"Resource.AssignVMToPool"}
+		if config.TemporaryPool {
+			privileges = append(privileges, "Resource.CreatePool", "Resource.DeletePool")
+		}
+		checks = append(checks, privilegeCheck{
+			name:       "resource pool '" + pool.InventoryPath + "'",
+			entity:     pool.Reference(),
+			privileges: privileges,
+		})
+	}
+	if config.DatastoreCluster != "" {
+		if pod, err := d.finder.DatastoreCluster(d.ctx, config.DatastoreCluster); err == nil {
+			checks = append(checks, privilegeCheck{
+				name:       "datastore cluster '" + config.DatastoreCluster + "'",
+				entity:     pod.Reference(),
+				privileges: []string{"Datastore.AllocateSpace"},
+			})
+		}
+	} else if datastore, err := d.finder.Datastore(d.ctx, config.Datastore); err == nil {
+		checks = append(checks, privilegeCheck{
+			name:       "datastore '" + datastore.Name() + "'",
+			entity:     datastore.Reference(),
+			privileges: []string{"Datastore.AllocateSpace"},
+		})
+	}
+	if datastore, err := d.finder.Datastore(d.ctx, config.IsoDatastore); err == nil {
+		checks = append(checks, privilegeCheck{
+			name:       "ISO datastore '" + datastore.Name() + "'",
+			entity:     datastore.Reference(),
+			privileges: []string{"Datastore.Browse"},
+		})
+	}
+	if network, err := d.finder.Network(d.ctx, config.Network); err == nil {
+		checks = append(checks, privilegeCheck{
+			name:       "network '" + config.Network + "'",
+			entity:     network.Reference(),
+			privileges: []string{"Network.Assign"},
+		})
+	}
+
+	userSession, err := d.client.SessionManager.UserSession(d.ctx)
+	if err != nil {
+		return nil, err
+	}
+	if userSession == nil {
+		return nil, errors.New("Not logged in")
+	}
+
+	var missing []error
+	for _, check := range checks {
+		req := types.HasPrivilegeOnEntities{
+			This:      *d.client.ServiceContent.AuthorizationManager,
+			Entity:    []types.ManagedObjectReference{check.entity},
+			SessionId: userSession.Key,
+			PrivId:    check.privileges,
+		}
+		res, err := methods.HasPrivilegeOnEntities(d.ctx, d.client.Client, &req)
+		if err != nil {
+			return nil, err
+		}
+
+		var denied []string
+		for _, entity := range res.Returnval {
+			for _, p := range entity.PrivAvailability {
+				if !p.IsGranted {
+					denied = append(denied, p.PrivId)
+				}
+			}
+		}
+		if len(denied) > 0 {
+			missing = append(missing, fmt.Errorf("Missing privileges on %v: %v", check.name, strings.Join(denied, ", ")))
+		}
+	}
+
+	return missing, nil
+}
+
+// CreateResourcePool creates a child resource pool with the given CPU (MHz) and memory (MB) limits, 0 being unlimited
+func (d *Driver) CreateResourcePool(parent string, name string, cpuLimit int64, ramLimit int64) (*object.ResourcePool, error) {
+	parentPool, err := d.finder.ResourcePoolOrDefault(d.ctx, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := types.DefaultResourceConfigSpec()
+	if cpuLimit > 0 {
+		spec.CpuAllocation.Limit = &cpuLimit
+	}
+	if ramLimit > 0 {
+		spec.MemoryAllocation.Limit = &ramLimit
+	}
+
+	poolPath := path.Join(parentPool.InventoryPath, name)
+	var pool *object.ResourcePool
+	var attempted bool
+	err = d.retry("Creating resource pool", func() error {
+		if attempted {
+			// The pool may have been created although the response was lost.
+			// Its name is unique to the build, so an existing pool is ours.
+			existing, err := d.finder.ResourcePool(d.ctx, poolPath)
+			if err == nil {
+				pool = existing
+				return nil
+			}
+			if _, ok := err.(*find.NotFoundError); !ok {
+				return err
+			}
+		}
+		attempted = true
+
+		var err error
+		pool, err = parentPool.Create(d.ctx, name, spec)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	pool.InventoryPath = poolPath
+	return pool, nil
+}
+
+// MoveToResourcePool moves the VM into the given resource pool, unless it is
+// a template or was destroyed
+func (d *Driver) MoveToResourcePool(vm *object.VirtualMachine, resourcePool string) error {
+	var mvm mo.VirtualMachine
+	err := vm.Properties(d.ctx, vm.Reference(), []string{"resourcePool"}, &mvm)
+	if err != nil {
+		if soap.IsSoapFault(err) {
+			if _, ok := soap.ToSoapFault(err).VimFault().(types.ManagedObjectNotFound); ok {
+				return nil
+			}
+		}
+		return err
+	}
+	if mvm.ResourcePool == nil {
+		return nil
+	}
+
+	pool, err := d.finder.ResourcePoolOrDefault(d.ctx, resourcePool)
 	if err != nil {
 		return err
 	}
-	_, err = task.WaitForResult(d.ctx, nil)
+
+	return d.retry("Moving VM to resource pool", func() error {
+		req := types.MoveIntoResourcePool{
+			This: pool.Reference(),
+			List: []types.ManagedObjectReference{vm.Reference()},
+		}
+		_, err := methods.MoveIntoResourcePool(d.ctx, d.client.Client, &req)
+		return err
+	})
+}
+
+// DestroyResourcePool deletes the resource pool
+func (d *Driver) DestroyResourcePool(pool *object.ResourcePool) error {
+	_, err := d.runTask("Deleting resource pool", func() (*object.Task, error) {
+		return pool.Destroy(d.ctx)
+	})
+	return err
+}
+
+// FindVM returns the VM named vm_name in the target folder, nil if there is none
+func (d *Driver) FindVM(config *CreateConfig) (*object.VirtualMachine, error) {
+	folder, err := d.Folder(config.Folder, false)
+	if err != nil {
+		if _, ok := err.(*find.NotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	vm, err := d.finder.VirtualMachine(d.ctx, path.Join(folder.InventoryPath, config.VMName))
+	if err != nil {
+		if _, ok := err.(*find.NotFoundError); ok {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return vm, nil
+}
+
+// CreatedByBuilder reports whether the VM or template was created by this
+// builder, i.e. it carries the builder marker. Annotations are free text anyone
+// can copy, so they do not prove ownership.
+func (d *Driver) CreatedByBuilder(vm *object.VirtualMachine) (bool, error) {
+	var mvm mo.VirtualMachine
+	err := vm.Properties(d.ctx, vm.Reference(), []string{"config.extraConfig"}, &mvm)
+	if err != nil {
+		return false, err
+	}
+	if mvm.Config == nil {
+		return false, nil
+	}
+
+	for _, option := range mvm.Config.ExtraConfig {
+		value := option.GetOptionValue()
+		if value.Key == builderMarkerKey && fmt.Sprint(value.Value) == BuilderId {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// DestroyVM destroys the VM
+func (d *Driver) DestroyVM(vm *object.VirtualMachine) error {
+	_, err := d.runTask("Destroying VM", func() (*object.Task, error) {
+		return vm.Destroy(d.ctx)
+	})
 	return err
 }
 
-// ConfigureVM configures the VM
-func (d *Driver) ConfigureVM(vm *object.VirtualMachine, config *HardwareConfig) error {
+// ConfigureVM configures the VM. The storage policies of createConfig are
+// assigned again, so reconfiguring does not reset them to the default policy.
+func (d *Driver) ConfigureVM(vm *object.VirtualMachine, config *HardwareConfig, params map[string]string, createConfig *CreateConfig) error {
 	var confSpec types.VirtualMachineConfigSpec
-	confSpec.NumCPUs = config.CPUs
-	confSpec.MemoryMB = config.RAM
 
-	var cpuSpec types.ResourceAllocationInfo
-	cpuSpec.Reservation = &config.CPUReservation
-	cpuSpec.Limit = &config.CPULimit
-	confSpec.CpuAllocation = &cpuSpec
+	if createConfig.storagePolicyID != "" || createConfig.diskStoragePolicyID != "" {
+		confSpec.VmProfile = profileSpec(createConfig.storagePolicyID)
+		changes, err := d.diskProfileChanges(vm, createConfig.diskPolicyID())
+		if err != nil {
+			return err
+		}
+		confSpec.DeviceChange = changes
+	}
+
+	if *config != (HardwareConfig{}) {
+		err := d.checkHostCapabilities(vm, config)
+		if err != nil {
+			return err
+		}
+
+		confSpec.NumCPUs = config.CPUs
+		if config.CPUCores > 0 {
+			// CPUs is the number of sockets, the VM needs the total number of cores
+			confSpec.NumCPUs = config.CPUs * config.CPUCores
+			confSpec.NumCoresPerSocket = config.CPUCores
+		}
+		confSpec.MemoryMB = config.RAM
 
-	var ramSpec types.ResourceAllocationInfo
-	ramSpec.Reservation = &config.RAMReservation
-	confSpec.MemoryAllocation = &ramSpec
+		var cpuSpec types.ResourceAllocationInfo
+		cpuSpec.Reservation = &config.CPUReservation
+		if config.CPULimit != 0 {
+			cpuSpec.Limit = &config.CPULimit
+		}
+		cpuSpec.Shares, _ = parseShares(config.CPUShares)
+		confSpec.CpuAllocation = &cpuSpec
 
-	confSpec.MemoryReservationLockedToMax = &config.RAMReserveAll
+		var ramSpec types.ResourceAllocationInfo
+		ramSpec.Reservation = &config.RAMReservation
+		ramSpec.Shares, _ = parseShares(config.RAMShares)
+		confSpec.MemoryAllocation = &ramSpec
+
+		confSpec.MemoryReservationLockedToMax = &config.RAMReserveAll
+
+		// Unset features keep their current value, false disables them
+		confSpec.CpuHotAddEnabled = config.CPUHotPlug
+		confSpec.MemoryHotAddEnabled = config.RAMHotPlug
+		confSpec.NestedHVEnabled = config.NestedHV
+		confSpec.VPMCEnabled = config.VPMCEnabled
+	}
+
+	confSpec.ExtraConfig = optionValues(params)
+
+	_, err := d.runTask("Reconfiguring VM", func() (*object.Task, error) {
+		return vm.Reconfigure(d.ctx, confSpec)
+	})
+	return err
+}
+
+// checkHostCapabilities verifies that the host running the VM supports the requested CPU features
+func (d *Driver) checkHostCapabilities(vm *object.VirtualMachine, config *HardwareConfig) error {
+	var mvm mo.VirtualMachine
+	err := vm.Properties(d.ctx, vm.Reference(), []string{"runtime.host"}, &mvm)
+	if err != nil {
+		return err
+	}
+	if mvm.Runtime.Host == nil {
+		return nil
+	}
 
-	task, err := vm.Reconfigure(d.ctx, confSpec)
+	var host mo.HostSystem
+	err = d.client.RetrieveOne(d.ctx, *mvm.Runtime.Host, []string{"name", "capability", "hardware.cpuInfo"}, &host)
 	if err != nil {
 		return err
 	}
-	_, err = task.WaitForResult(d.ctx, nil)
+
+	if isTrue(config.NestedHV) && (host.Capability == nil || host.Capability.NestedHVSupported == nil || !*host.Capability.NestedHVSupported) {
+		return fmt.Errorf("Host '%v' does not support nested hardware virtualization", host.Name)
+	}
+	if isTrue(config.VPMCEnabled) && (host.Capability == nil || host.Capability.VPMCSupported == nil || !*host.Capability.VPMCSupported) {
+		return fmt.Errorf("Host '%v' does not support virtual CPU performance counters", host.Name)
+	}
+
+	cores := config.CPUs
+	if config.CPUCores > 0 {
+		cores = config.CPUs * config.CPUCores
+	}
+	if host.Hardware != nil && cores > int32(host.Hardware.CpuInfo.NumCpuThreads) {
+		return fmt.Errorf("VM requires %v virtual CPUs, host '%v' has only %v logical CPUs", cores, host.Name, host.Hardware.CpuInfo.NumCpuThreads)
+	}
+
+	return nil
+}
+
+// RemoveExtraConfig removes the given keys from the VM's advanced settings
+func (d *Driver) RemoveExtraConfig(vm *object.VirtualMachine, keys []string) error {
+	var confSpec types.VirtualMachineConfigSpec
+	for _, key := range keys {
+		// An empty value deletes the key
+		confSpec.ExtraConfig = append(confSpec.ExtraConfig, &types.OptionValue{Key: key, Value: ""})
+	}
+
+	_, err := d.runTask("Removing configuration parameters", func() (*object.Task, error) {
+		return vm.Reconfigure(d.ctx, confSpec)
+	})
 	return err
 }
 
 // PowerOn powers on the VM
 func (d *Driver) PowerOn(vm *object.VirtualMachine) error {
-	task, err := vm.PowerOn(d.ctx)
-	if err != nil {
-		return err
-	}
-	_, err = task.WaitForResult(d.ctx, nil)
+	_, err := d.runTask("Powering on VM", func() (*object.Task, error) {
+		return vm.PowerOn(d.ctx)
+	})
 	return err
 }
 
@@ -204,6 +1097,65 @@ func (d *Driver) WaitForIP(vm *object.VirtualMachine) (string, error) {
 	return ip, nil
 }
 
+// WaitForTools waits for VMware Tools to start running in the guest
+func (d *Driver) WaitForTools(vm *object.VirtualMachine) error {
+	p := property.DefaultCollector(d.client.Client)
+	return property.Wait(d.ctx, p, vm.Reference(), []string{"guest.toolsRunningStatus"}, func(pc []types.PropertyChange) bool {
+		for _, c := range pc {
+			if c.Name != "guest.toolsRunningStatus" || c.Val == nil {
+				continue
+			}
+			if c.Val.(string) == string(types.VirtualMachineToolsRunningStatusGuestToolsRunning) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// IsWindowsGuest reports whether the guest OS is of the Windows family
+func (d *Driver) IsWindowsGuest(vm *object.VirtualMachine) (bool, error) {
+	var mvm mo.VirtualMachine
+	err := vm.Properties(d.ctx, vm.Reference(), []string{"guest.guestFamily", "config.guestId"}, &mvm)
+	if err != nil {
+		return false, err
+	}
+
+	if mvm.Guest != nil && mvm.Guest.GuestFamily != "" {
+		return mvm.Guest.GuestFamily == string(types.VirtualMachineGuestOsFamilyWindowsGuest), nil
+	}
+	return mvm.Config != nil && strings.HasPrefix(mvm.Config.GuestId, "win"), nil
+}
+
+// maxGuestFileSize limits the size of the small files read from the guest
+const maxGuestFileSize = 64 * 1024
+
+// ReadGuestFile reads a small file from the guest through the VMware Tools guest operations
+func (d *Driver) ReadGuestFile(vm *object.VirtualMachine, username string, password string, name string) ([]byte, error) {
+	fm, err := guest.NewOperationsManager(d.client.Client, vm.Reference()).FileManager(d.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := &types.NamePasswordAuthentication{Username: username, Password: password}
+	info, err := fm.InitiateFileTransferFromGuest(d.ctx, auth, name)
+	if err != nil {
+		return nil, err
+	}
+	u, err := d.client.ParseURL(info.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	r, _, err := d.client.Download(d.ctx, u, &soap.DefaultDownload)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(io.LimitReader(r, maxGuestFileSize))
+}
+
 // PowerOff powers of the VM
 func (d *Driver) PowerOff(vm *object.VirtualMachine) error {
 	state, err := vm.PowerState(d.ctx)
@@ -215,18 +1167,17 @@ func (d *Driver) PowerOff(vm *object.VirtualMachine) error {
 		return nil
 	}
 
-	task, err := vm.PowerOff(d.ctx)
-	if err != nil {
-		return err
-	}
-	_, err = task.WaitForResult(d.ctx, nil)
+	_, err = d.runTask("Powering off VM", func() (*object.Task, error) {
+		return vm.PowerOff(d.ctx)
+	})
 	return err
 }
 
 // StartShutdown starts the guest shutdown process
 func (d *Driver) StartShutdown(vm *object.VirtualMachine) error {
-	err := vm.ShutdownGuest(d.ctx)
-	return err
+	return d.retry("Shutting down guest", func() error {
+		return vm.ShutdownGuest(d.ctx)
+	})
 }
 
 // WaitForShutdown waits for the VM to shutdown
@@ -254,24 +1205,35 @@ func (d *Driver) WaitForShutdown(vm *object.VirtualMachine, timeout time.Duratio
 
 // CreateSnapshot creates a snapshot of the VM
 func (d *Driver) CreateSnapshot(vm *object.VirtualMachine) error {
-	task, err := vm.CreateSnapshot(d.ctx, "Created by Packer", "", false, false)
-	if err != nil {
-		return err
-	}
-	_, err = task.WaitForResult(d.ctx, nil)
+	_, err := d.runTask("Creating snapshot", func() (*object.Task, error) {
+		return vm.CreateSnapshot(d.ctx, "Created by Packer", "", false, false)
+	})
 	return err
 }
 
 // ConvertToTemplate converts the VM to a template
 func (d *Driver) ConvertToTemplate(vm *object.VirtualMachine) error {
-	err := vm.MarkAsTemplate(d.ctx)
-	return err
+	return d.retry("Converting VM to template", func() error {
+		// A previous attempt may have converted the VM although the response was lost
+		var mvm mo.VirtualMachine
+		err := vm.Properties(d.ctx, vm.Reference(), []string{"config.template"}, &mvm)
+		if err != nil {
+			return err
+		}
+		if mvm.Config != nil && mvm.Config.Template {
+			return nil
+		}
+		return vm.MarkAsTemplate(d.ctx)
+	})
 }
 
 // Device handles the complex calls to configure the network adapter
 func (d *Driver) Device(networkname string, netadaptertype string) (types.BaseVirtualDevice, error) {
 
 	network, err := d.finder.Network(d.ctx, networkname)
+	if err != nil {
+		return nil, err
+	}
 
 	backing, err := network.EthernetCardBackingInfo(context.TODO())
 	if err != nil {
@@ -292,6 +1254,36 @@ func (d *Driver) Device(networkname string, netadaptertype string) (types.BaseVi
 	return device, nil
 }
 
+// ethernetCardTypes returns the supported network adapter types
+func ethernetCardTypes() []string {
+	var names []string
+	cards := object.EthernetCardTypes()
+	for _, device := range cards {
+		names = append(names, deviceType(cards, device))
+	}
+	return names
+}
+
+// scsiControllerTypes returns the supported disk controller types
+func scsiControllerTypes() []string {
+	var names []string
+	controllers := object.SCSIControllerTypes()
+	for _, device := range controllers {
+		names = append(names, controllers.Type(device))
+	}
+	return names
+}
+
+// isSCSIControllerType reports whether the disk controller type is supported
+func isSCSIControllerType(name string) bool {
+	return containsString(scsiControllerTypes(), name)
+}
+
+// isEthernetCardType reports whether the network adapter type is supported
+func isEthernetCardType(name string) bool {
+	return containsString(ethernetCardTypes(), name)
+}
+
 // addNetwork adds the network adapter to the VM
 func (d *Driver) addNetwork(devices object.VirtualDeviceList, networkname string, netadaptertype string) (object.VirtualDeviceList, error) {
 	netdev, err := d.Device(networkname, netadaptertype)
@@ -304,40 +1296,61 @@ func (d *Driver) addNetwork(devices object.VirtualDeviceList, networkname string
 }
 
 // addStorage adds the CD-ROM and Hard Disk to the VM
-func (d *Driver) addStorage(devices object.VirtualDeviceList, isopath string, isofile string, diskbytesize int64) (object.VirtualDeviceList, error) {
+func (d *Driver) addStorage(devices object.VirtualDeviceList, isopath string, isofile string, diskbytesize int64, diskcontroller string, cdromtype string) (object.VirtualDeviceList, error) {
 
 	// Create SCSI Controller for Hard Disk
-	scsi, err := devices.CreateSCSIController("scsi")
+	if diskcontroller == "" {
+		diskcontroller = "scsi"
+	}
+	scsi, err := devices.CreateSCSIController(diskcontroller)
 	if err != nil {
 		return nil, err
 	}
 
 	devices = append(devices, scsi)
 
-	// Create IDE Controller for CD-ROM
-	idecontroller, err := devices.CreateIDEController()
-	if err != nil {
-		return nil, err
-	}
+	// Add a CD-ROM
+	var cdrom *types.VirtualCdrom
+	if cdromtype == "sata" {
+		// Create SATA Controller for CD-ROM
+		sata := &types.VirtualAHCIController{}
+		sata.Key = devices.NewKey()
+		devices = append(devices, sata)
+
+		cdrom = &types.VirtualCdrom{}
+		cdrom.Key = devices.NewKey()
+		cdrom.Connectable = &types.VirtualDeviceConnectInfo{
+			AllowGuestControl: true,
+			StartConnected:    true,
+		}
+		devices.AssignController(cdrom, sata)
+	} else {
+		// Create IDE Controller for CD-ROM
+		idecontroller, err := devices.CreateIDEController()
+		if err != nil {
+			return nil, err
+		}
 
-	devices = append(devices, idecontroller)
+		devices = append(devices, idecontroller)
 
-	// Add a CD-ROM to the IDE Controller
+		// Find the IDE controller
+		ide, err := devices.FindIDEController("")
+		if err != nil {
+			return nil, err
+		}
 
-	// Find the IDE controller
-	ide, err := devices.FindIDEController("")
-	if err != nil {
-		return nil, err
+		// Create the CD-ROM Drive
+		cdrom, err = devices.CreateCdrom(ide)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// Create the CD-ROM Drive
-	cdrom, err := devices.CreateCdrom(ide)
+	// Find the datastore the specified for the ISO
+	isodatastore, err := d.finder.Datastore(d.ctx, isopath)
 	if err != nil {
 		return nil, err
 	}
-
-	// Find the datastore the specified for the ISO
-	isodatastore, err := d.finder.Datastore(d.ctx, isopath)
 	cdrom = devices.InsertIso(cdrom, isodatastore.Path(isofile))
 	devices = append(devices, cdrom)
 
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vmware/govmomi/vim25/soap"
+)
+
+func TestVerifyThumbprint(t *testing.T) {
+	server := httptest.NewTLSServer(nil)
+	defer server.Close()
+	cert := server.Certificate()
+	rawCerts := [][]byte{cert.Raw}
+
+	verify := verifyThumbprint(&tls.Config{}, "vcenter.domain.local", soap.ThumbprintSHA1(cert))
+	if err := verify(rawCerts, nil); err != nil {
+		t.Errorf("Matching thumbprint should be accepted: %s", err)
+	}
+
+	verify = verifyThumbprint(&tls.Config{}, "vcenter.domain.local", "AB:CD")
+	if err := verify(rawCerts, nil); err == nil || !isCertificateError(err) {
+		t.Errorf("Thumbprint mismatch should be a certificate error, got %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	verify = verifyThumbprint(&tls.Config{RootCAs: roots}, "example.com", "AB:CD")
+	if err := verify(rawCerts, nil); err != nil {
+		t.Errorf("Certificate signed by a trusted CA should be accepted: %s", err)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// normalizeFolder cleans up a folder path from the template, removing
+// duplicate and trailing slashes
+func normalizeFolder(folder string) (string, error) {
+	folder = strings.TrimSpace(folder)
+	if folder == "" {
+		return "", nil
+	}
+	for _, part := range strings.Split(folder, "/") {
+		if part == "." || part == ".." {
+			return "", fmt.Errorf("Invalid 'folder' '%v': '.' and '..' are not allowed", folder)
+		}
+	}
+
+	folder = path.Clean(folder)
+	if folder == "." {
+		return "", nil
+	}
+	return folder, nil
+}
+
+// vmFolderPath returns the inventory path of the datacenter's VM folder. The
+// datacenter may itself be nested in inventory folders.
+func (d *Driver) vmFolderPath() string {
+	return path.Join(d.datacenter.InventoryPath, "vm")
+}
+
+// vmFolder returns the VM folder of the datacenter
+func (d *Driver) vmFolder() (*object.Folder, error) {
+	folders, err := d.datacenter.Folders(d.ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Folders assumes the datacenter is at the root of the inventory
+	folder := folders.VmFolder
+	folder.InventoryPath = d.vmFolderPath()
+	return folder, nil
+}
+
+// folderPath returns the inventory path of a folder. Relative paths are
+// relative to the datacenter's VM folder, absolute paths must be inside it
+func (d *Driver) folderPath(folder string) (string, error) {
+	root := d.vmFolderPath()
+	if !strings.HasPrefix(folder, "/") {
+		return path.Join(root, folder), nil
+	}
+	if folder != root && !strings.HasPrefix(folder, root+"/") {
+		return "", fmt.Errorf("Folder '%v' is not inside the VM folder '%v' of the datacenter", folder, root)
+	}
+	return folder, nil
+}
+
+// Folder returns the VM folder, creating the missing folders of its path
+// when create is set
+func (d *Driver) Folder(folder string, create bool) (*object.Folder, error) {
+	p, err := d.folderPath(folder)
+	if err != nil {
+		return nil, err
+	}
+	if !create {
+		return d.finder.Folder(d.ctx, p)
+	}
+
+	root, err := d.vmFolder()
+	if err != nil {
+		return nil, err
+	}
+	return d.createFolder(root, p)
+}
+
+// createFolder returns the folder at the inventory path p, creating it and
+// its missing parents up to the VM folder root
+func (d *Driver) createFolder(root *object.Folder, p string) (*object.Folder, error) {
+	if p == root.InventoryPath {
+		return root, nil
+	}
+	if !strings.HasPrefix(p, root.InventoryPath+"/") {
+		return nil, fmt.Errorf("Folder '%v' is not inside the VM folder '%v' of the datacenter", p, root.InventoryPath)
+	}
+
+	folder, err := d.finder.Folder(d.ctx, p)
+	if err == nil {
+		return folder, nil
+	}
+	if _, ok := err.(*find.NotFoundError); !ok {
+		return nil, err
+	}
+
+	parent, err := d.createFolder(root, path.Dir(p))
+	if err != nil {
+		return nil, err
+	}
+
+	folder, err = parent.CreateFolder(d.ctx, path.Base(p))
+	if err != nil {
+		// Another build may have created the folder in the meantime
+		if soap.IsSoapFault(err) {
+			if _, ok := soap.ToSoapFault(err).VimFault().(types.DuplicateName); ok {
+				return d.finder.Folder(d.ctx, p)
+			}
+		}
+		return nil, fmt.Errorf("Error creating folder '%v': %s", p, err)
+	}
+	folder.InventoryPath = p
+
+	if d.ui != nil {
+		d.ui.Message(fmt.Sprintf("Created folder '%v'", p))
+	}
+	return folder, nil
+}
+
+// existingFolder returns the folder at the inventory path p or, when it is
+// missing, its nearest existing parent inside the VM folder
+func (d *Driver) existingFolder(p string) (*object.Folder, error) {
+	root := d.vmFolderPath()
+	for {
+		if p == root {
+			return d.vmFolder()
+		}
+		folder, err := d.finder.Folder(d.ctx, p)
+		if err == nil {
+			return folder, nil
+		}
+		if _, ok := err.(*find.NotFoundError); !ok || !strings.HasPrefix(p, root+"/") {
+			return nil, err
+		}
+		p = path.Dir(p)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+func TestFolderPath(t *testing.T) {
+	dc := object.NewDatacenter(nil, types.ManagedObjectReference{Type: "Datacenter", Value: "datacenter-1"})
+	dc.InventoryPath = "/Region/DC"
+	d := &Driver{datacenter: dc}
+
+	paths := map[string]string{
+		"":                        "/Region/DC/vm",
+		"templates/linux":         "/Region/DC/vm/templates/linux",
+		"/Region/DC/vm":           "/Region/DC/vm",
+		"/Region/DC/vm/templates": "/Region/DC/vm/templates",
+	}
+	for folder, expected := range paths {
+		p, err := d.folderPath(folder)
+		if err != nil {
+			t.Errorf("%v: %s", folder, err)
+		} else if p != expected {
+			t.Errorf("%v: expected '%v', got '%v'", folder, expected, p)
+		}
+	}
+
+	for _, folder := range []string{"/DC/vm/templates", "/Region/DC/host"} {
+		if _, err := d.folderPath(folder); err == nil {
+			t.Errorf("%v is outside the VM folder, an error is expected", folder)
+		}
+	}
+}
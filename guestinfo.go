@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// GuestInfoConfig holds the guestinfo data injected into the VM at creation time.
+type GuestInfoConfig struct {
+	GuestInfoUserdataFile string            `mapstructure:"guestinfo_userdata_file"`
+	GuestInfoMetadataFile string            `mapstructure:"guestinfo_metadata_file"`
+	GuestInfoIgnitionFile string            `mapstructure:"guestinfo_ignition_file"`
+	GuestInfoEncoding     string            `mapstructure:"guestinfo_encoding"`
+	GuestInfo             map[string]string `mapstructure:"guestinfo"`
+}
+
+// Prepare the guestinfo injection
+func (c *GuestInfoConfig) Prepare() []error {
+	var errs []error
+
+	if c.GuestInfoEncoding == "" {
+		c.GuestInfoEncoding = "base64"
+	}
+	if c.GuestInfoEncoding != "base64" && c.GuestInfoEncoding != "gzip+base64" {
+		errs = append(errs, fmt.Errorf("'guestinfo_encoding' must be 'base64' or 'gzip+base64', got '%v'", c.GuestInfoEncoding))
+	}
+
+	for _, file := range []string{c.GuestInfoUserdataFile, c.GuestInfoMetadataFile, c.GuestInfoIgnitionFile} {
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil {
+			errs = append(errs, fmt.Errorf("Cannot access guestinfo file '%v': %s", file, err))
+		}
+	}
+
+	return errs
+}
+
+// ExtraConfig returns the encoded guestinfo variables to set on the VM
+func (c *GuestInfoConfig) ExtraConfig() ([]types.BaseOptionValue, error) {
+	var opts []types.BaseOptionValue
+
+	files := []struct {
+		key  string
+		path string
+	}{
+		{"guestinfo.userdata", c.GuestInfoUserdataFile},
+		{"guestinfo.metadata", c.GuestInfoMetadataFile},
+		{"guestinfo.ignition.config.data", c.GuestInfoIgnitionFile},
+	}
+	for _, f := range files {
+		if f.path == "" {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(f.path)
+		if err != nil {
+			return nil, err
+		}
+		value, err := encodeGuestInfo(data, c.GuestInfoEncoding)
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts,
+			&types.OptionValue{Key: f.key, Value: value},
+			&types.OptionValue{Key: f.key + ".encoding", Value: c.GuestInfoEncoding},
+		)
+	}
+
+	for _, key := range c.guestInfoKeys() {
+		opts = append(opts, &types.OptionValue{Key: guestInfoKey(key), Value: c.GuestInfo[key]})
+	}
+
+	return opts, nil
+}
+
+// Keys returns all guestinfo variables set by ExtraConfig
+func (c *GuestInfoConfig) Keys() []string {
+	var keys []string
+
+	if c.GuestInfoUserdataFile != "" {
+		keys = append(keys, "guestinfo.userdata", "guestinfo.userdata.encoding")
+	}
+	if c.GuestInfoMetadataFile != "" {
+		keys = append(keys, "guestinfo.metadata", "guestinfo.metadata.encoding")
+	}
+	if c.GuestInfoIgnitionFile != "" {
+		keys = append(keys, "guestinfo.ignition.config.data", "guestinfo.ignition.config.data.encoding")
+	}
+	for _, key := range c.guestInfoKeys() {
+		keys = append(keys, guestInfoKey(key))
+	}
+
+	return keys
+}
+
+// guestInfoKeys returns the keys of the generic guestinfo map in a stable order
+func (c *GuestInfoConfig) guestInfoKeys() []string {
+	var keys []string
+	for key := range c.GuestInfo {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func guestInfoKey(key string) string {
+	if strings.HasPrefix(key, "guestinfo.") {
+		return key
+	}
+	return "guestinfo." + key
+}
+
+func encodeGuestInfo(data []byte, encoding string) (string, error) {
+	if encoding == "gzip+base64" {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return "", err
+		}
+		if err := w.Close(); err != nil {
+			return "", err
+		}
+		data = buf.Bytes()
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
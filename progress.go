@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/packer/packer"
+	"github.com/vmware/govmomi/vim25/progress"
+)
+
+// progressInterval is the minimum time between two progress messages of a task
+const progressInterval = 5 * time.Second
+
+// taskProgress reports the progress of a vSphere task to the Packer UI
+type taskProgress struct {
+	ui       packer.Ui
+	name     string
+	interval time.Duration
+}
+
+// progressSink returns the sink passed to the tasks of the driver, nil when
+// there is no UI to report to
+func (d *Driver) progressSink(name string) progress.Sinker {
+	if d.ui == nil {
+		return nil
+	}
+	return &taskProgress{ui: d.ui, name: name, interval: progressInterval}
+}
+
+// Sink implements the progress.Sinker interface
+func (p *taskProgress) Sink() chan<- progress.Report {
+	ch := make(chan progress.Report)
+	go p.report(ch)
+	return ch
+}
+
+// report prints the reports received until the task completes, skipping
+// those that repeat the last percentage or arrive within the interval
+func (p *taskProgress) report(ch <-chan progress.Report) {
+	var last time.Time
+	lastPercentage := float32(-1)
+
+	for r := range ch {
+		if r.Error() != nil {
+			continue
+		}
+		percentage := r.Percentage()
+		if percentage == lastPercentage || (percentage < 100 && time.Since(last) < p.interval) {
+			continue
+		}
+		last = time.Now()
+		lastPercentage = percentage
+
+		msg := fmt.Sprintf("%v: %.0f%%", p.name, percentage)
+		if detail := r.Detail(); detail != "" {
+			msg += fmt.Sprintf(" (%v)", detail)
+		}
+		p.ui.Message(msg)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/packer/packer"
+	"github.com/vmware/govmomi/vim25/progress"
+)
+
+type testReport struct {
+	percentage float32
+}
+
+func (r testReport) Percentage() float32 { return r.percentage }
+func (r testReport) Detail() string      { return "" }
+func (r testReport) Error() error        { return nil }
+
+func TestTaskProgress(t *testing.T) {
+	tests := []struct {
+		interval    time.Duration
+		percentages []float32
+		expected    []string
+	}{
+		{time.Hour, []float32{10, 20, 20, 50, 100}, []string{"Creating VM: 10%", "Creating VM: 100%"}},
+		{0, []float32{10, 20, 20, 100}, []string{"Creating VM: 10%", "Creating VM: 20%", "Creating VM: 100%"}},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		p := &taskProgress{ui: &packer.BasicUi{Writer: &out}, name: "Creating VM", interval: test.interval}
+
+		ch := make(chan progress.Report)
+		done := make(chan struct{})
+		go func() {
+			p.report(ch)
+			close(done)
+		}()
+		for _, percentage := range test.percentages {
+			ch <- testReport{percentage}
+		}
+		close(ch)
+		<-done
+
+		messages := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if strings.Join(messages, ", ") != strings.Join(test.expected, ", ") {
+			t.Errorf("interval %v: expected %v, got %v", test.interval, test.expected, messages)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/task"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const (
+	retryInitialDelay = 1 * time.Second
+	retryMaxDelay     = 30 * time.Second
+)
+
+// retry runs op until it succeeds, fails with a fault that is not transient
+// or the retry budget is spent, doubling the delay between attempts
+func (d *Driver) retry(name string, op func() error) error {
+	return d.retryWhen(name, isRetryable, op)
+}
+
+// retryWhen runs op like retry, retrying the errors accepted by retryable
+func (d *Driver) retryWhen(name string, retryable func(error) bool, op func() error) error {
+	return d.retryUntil(name, time.Now().Add(d.retryBudget), retryable, op)
+}
+
+// retryUntil runs op like retryWhen, without retrying past the deadline
+func (d *Driver) retryUntil(name string, deadline time.Time, retryable func(error) bool, op func() error) error {
+	delay := retryInitialDelay
+
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || !retryable(err) {
+			return err
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return err
+		}
+
+		msg := fmt.Sprintf("%v failed with a transient error, retrying in %v (attempt %v): %s", name, delay, attempt, err)
+		if d.ui != nil {
+			d.ui.Message(msg)
+		} else {
+			log.Print(msg)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-d.ctx.Done():
+			return err
+		}
+
+		delay *= 2
+		if delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+	}
+}
+
+// runTask starts a task and waits for its result. The task is started again
+// when starting it failed or the task itself faulted with a transient fault.
+// Other errors while waiting only retry the wait: the task may still complete
+// on the server, and starting it again would e.g. create a second VM. Both
+// share a single retry budget.
+func (d *Driver) runTask(name string, start func() (*object.Task, error)) (*types.TaskInfo, error) {
+	var info *types.TaskInfo
+	var started bool
+	deadline := time.Now().Add(d.retryBudget)
+
+	restartable := func(err error) bool {
+		if _, faulted := err.(task.Error); started && !faulted {
+			return false
+		}
+		return isRetryable(err)
+	}
+	waitable := func(err error) bool {
+		_, faulted := err.(task.Error)
+		return !faulted && isRetryable(err)
+	}
+
+	err := d.retryUntil(name, deadline, restartable, func() error {
+		started = false
+		t, err := start()
+		if err != nil {
+			return err
+		}
+		started = true
+
+		return d.retryUntil(name, deadline, waitable, func() error {
+			var err error
+			info, err = t.WaitForResult(d.ctx, d.progressSink(name))
+			return err
+		})
+	})
+	return info, err
+}
+
+// isRetryable reports whether err is a transient fault: a busy or concurrently
+// modified object, a temporarily unavailable vCenter or a lost connection
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	// Task faults are pointers, SOAP faults values
+	var fault types.AnyType
+	switch e := err.(type) {
+	case task.Error:
+		if e.LocalizedMethodFault != nil {
+			fault = e.Fault()
+		}
+	default:
+		if soap.IsSoapFault(err) {
+			fault = soap.ToSoapFault(err).VimFault()
+		} else if soap.IsVimFault(err) {
+			fault = soap.ToVimFault(err)
+		}
+	}
+	if fault != nil {
+		switch fault.(type) {
+		case *types.TaskInProgress, types.TaskInProgress,
+			*types.ConcurrentAccess, types.ConcurrentAccess,
+			*types.HostCommunication, types.HostCommunication,
+			*types.HostNotReachable, types.HostNotReachable:
+			return true
+		}
+		return false
+	}
+
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if netErr, ok := err.(net.Error); ok && (netErr.Timeout() || netErr.Temporary()) {
+		return true
+	}
+
+	msg := err.Error()
+	for _, transient := range []string{"503 Service Unavailable", "connection reset", "connection refused", "broken pipe"} {
+		if strings.Contains(msg, transient) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/sts"
+	"github.com/vmware/govmomi/vim25/methods"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// reloginRoundTripper logs in again and retries the call when vCenter
+// reports that the session is no longer authenticated
+type reloginRoundTripper struct {
+	soap.RoundTripper
+	login func(ctx context.Context) error
+	mu    sync.Mutex
+}
+
+// RoundTrip implements the soap.RoundTripper interface
+func (rt *reloginRoundTripper) RoundTrip(ctx context.Context, req, res soap.HasFault) error {
+	err := rt.RoundTripper.RoundTrip(ctx, req, res)
+	if !isNotAuthenticated(err) {
+		return err
+	}
+
+	switch req.(type) {
+	case *methods.LoginBody, *methods.LoginByTokenBody, *methods.LogoutBody:
+		return err
+	}
+
+	log.Printf("vCenter session is not authenticated, logging in again")
+	rt.mu.Lock()
+	loginErr := rt.login(ctx)
+	rt.mu.Unlock()
+	if loginErr != nil {
+		return loginErr
+	}
+
+	resetFault(res)
+	return rt.RoundTripper.RoundTrip(ctx, req, res)
+}
+
+func isNotAuthenticated(err error) bool {
+	if err == nil || !soap.IsSoapFault(err) {
+		return false
+	}
+	_, ok := soap.ToSoapFault(err).VimFault().(types.NotAuthenticated)
+	return ok
+}
+
+// resetFault clears the fault decoded from a failed response, so the
+// response can be decoded again
+func resetFault(res soap.HasFault) {
+	v := reflect.ValueOf(res)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return
+	}
+	if f := v.FieldByName("Fault_"); f.IsValid() && f.CanSet() {
+		f.Set(reflect.Zero(f.Type()))
+	}
+}
+
+// loginByToken logs in with a pre-issued SAML bearer token, or with a
+// holder-of-key token issued by the STS for a solution user certificate
+func loginByToken(ctx context.Context, client *govmomi.Client, config *ConnectConfig) error {
+	var signer *sts.Signer
+
+	if config.SAMLTokenFile != "" {
+		token, err := ioutil.ReadFile(config.SAMLTokenFile)
+		if err != nil {
+			return fmt.Errorf("Error loading 'saml_token_file': %s", err)
+		}
+		signer = &sts.Signer{Token: string(token)}
+	} else {
+		cert, err := tls.LoadX509KeyPair(config.SolutionUserCertificate, config.SolutionUserKey)
+		if err != nil {
+			return fmt.Errorf("Error loading solution user certificate: %s", err)
+		}
+
+		stsClient, err := sts.NewClient(ctx, client.Client)
+		if err != nil {
+			return err
+		}
+		signer, err = stsClient.Issue(ctx, sts.TokenRequest{
+			Certificate: &cert,
+			Delegatable: true,
+		})
+		if err != nil {
+			return fmt.Errorf("Error issuing holder-of-key token: %s", err)
+		}
+	}
+
+	header := soap.Header{Security: signer}
+	return client.SessionManager.LoginByToken(client.WithHeader(ctx, header))
+}
+
+// sessionCacheFile returns the file caching the session of an identity on a vCenter server
+func sessionCacheFile(dir string, u *url.URL, identity string) string {
+	sum := sha1.Sum([]byte(u.Host + u.Path + "#" + identity))
+	return filepath.Join(dir, hex.EncodeToString(sum[:]))
+}
+
+// sessionIdentity identifies who logs in, so each identity gets its own session
+// cache: the username, or the token or certificate file under token authentication
+func (c *ConnectConfig) sessionIdentity() string {
+	var prefix, file string
+	switch {
+	case c.SAMLTokenFile != "":
+		prefix, file = "saml-token:", c.SAMLTokenFile
+	case c.SolutionUserCertificate != "":
+		prefix, file = "solution-user:", c.SolutionUserCertificate
+	default:
+		return c.Username
+	}
+
+	if abs, err := filepath.Abs(file); err == nil {
+		file = abs
+	}
+	return prefix + file
+}
+
+// loadSession restores the session cookies from the cache file
+func loadSession(file string, client *soap.Client, u *url.URL) bool {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false
+	}
+
+	var cookies []*http.Cookie
+	if err := json.Unmarshal(data, &cookies); err != nil {
+		log.Printf("Ignoring invalid session cache '%v': %s", file, err)
+		return false
+	}
+	client.Jar.SetCookies(u, cookies)
+	return true
+}
+
+// saveSession writes the session cookies to the cache file
+func saveSession(file string, client *soap.Client, u *url.URL) error {
+	data, err := json.Marshal(client.Jar.Cookies(u))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0600)
+}
@@ -3,47 +3,231 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strings"
 
 	packerssh "github.com/hashicorp/packer/communicator/ssh"
+	"github.com/hashicorp/packer/helper/communicator"
 	"github.com/mitchellh/multistep"
+	"github.com/vmware/govmomi/object"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
+var md5FingerprintRegexp = regexp.MustCompile(`^([0-9a-f]{2}:){15}[0-9a-f]{2}$`)
+
+// SSHConfig holds the SSH authentication and host key verification settings.
+type SSHConfig struct {
+	SSHPrivateKeyPassphrase string `mapstructure:"ssh_private_key_passphrase"`
+	SSHCertificateFile      string `mapstructure:"ssh_certificate_file"`
+	SSHHostKeyFingerprint   string `mapstructure:"ssh_host_key_fingerprint"`
+	SSHHostKeyGuestFile     string `mapstructure:"ssh_host_key_guest_file"`
+}
+
+// Prepare the SSH authentication and host key verification
+func (c *SSHConfig) Prepare(comm *communicator.Config) []error {
+	var errs []error
+
+	if comm.SSHPrivateKey == "" {
+		if c.SSHPrivateKeyPassphrase != "" {
+			errs = append(errs, fmt.Errorf("'ssh_private_key_passphrase' requires 'ssh_private_key_file'"))
+		}
+		if c.SSHCertificateFile != "" {
+			errs = append(errs, fmt.Errorf("'ssh_certificate_file' requires 'ssh_private_key_file'"))
+		}
+	} else if c.SSHPrivateKeyPassphrase != "" || c.SSHCertificateFile != "" {
+		// The communicator cannot parse password protected keys, and its errors
+		// about them are dropped, so the key is checked here with the passphrase
+		if _, err := os.Stat(comm.SSHPrivateKey); err != nil {
+			errs = append(errs, fmt.Errorf("'ssh_private_key_file' is invalid: %s", err))
+		} else if _, err := sshSigner(comm.SSHPrivateKey, c.SSHPrivateKeyPassphrase, c.SSHCertificateFile); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if c.SSHHostKeyFingerprint != "" && c.SSHHostKeyGuestFile != "" {
+		errs = append(errs, fmt.Errorf("'ssh_host_key_fingerprint' and 'ssh_host_key_guest_file' cannot be used together"))
+	}
+	if c.SSHHostKeyGuestFile != "" && comm.SSHPassword == "" {
+		// Guest operations authenticate with a password only
+		errs = append(errs, fmt.Errorf("'ssh_host_key_guest_file' requires 'ssh_password' to read the file through VMware Tools"))
+	}
+	if c.SSHHostKeyFingerprint != "" {
+		fp := strings.TrimPrefix(strings.ToLower(c.SSHHostKeyFingerprint), "md5:")
+		if !strings.HasPrefix(c.SSHHostKeyFingerprint, "SHA256:") && !md5FingerprintRegexp.MatchString(fp) {
+			errs = append(errs, fmt.Errorf("'ssh_host_key_fingerprint' must be a SHA256 or MD5 fingerprint, got '%v'", c.SSHHostKeyFingerprint))
+		}
+	}
+
+	return errs
+}
+
+// withoutPrivateKeyErrors drops the communicator errors about ssh_private_key_file,
+// which it reports for every password protected key
+func withoutPrivateKeyErrors(errs []error) []error {
+	var result []error
+	for _, err := range errs {
+		if !strings.HasPrefix(err.Error(), "ssh_private_key_file is invalid") {
+			result = append(result, err)
+		}
+	}
+	return result
+}
+
+// StepConnectSSHAgent defines the SSH agent connection step
+type StepConnectSSHAgent struct {
+	agentAuth bool
+}
+
+// Run connects to the SSH agent once, for every SSH connection attempt of the communicator
+func (s *StepConnectSSHAgent) Run(state multistep.StateBag) multistep.StepAction {
+	if !s.agentAuth {
+		return multistep.ActionContinue
+	}
+
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		state.Put("error", fmt.Errorf("SSH_AUTH_SOCK is not set, cannot use the SSH agent"))
+		return multistep.ActionHalt
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		state.Put("error", fmt.Errorf("Error connecting to SSH agent: %s", err))
+		return multistep.ActionHalt
+	}
+	state.Put("ssh_agent_conn", conn)
+
+	return multistep.ActionContinue
+}
+
+// Cleanup closes the SSH agent connection
+func (s *StepConnectSSHAgent) Cleanup(state multistep.StateBag) {
+	if conn, ok := state.GetOk("ssh_agent_conn"); ok {
+		conn.(net.Conn).Close()
+	}
+}
+
 func commHost(state multistep.StateBag) (string, error) {
 	return state.Get("ip").(string), nil
 }
 
 func sshConfig(state multistep.StateBag) (*ssh.ClientConfig, error) {
 	config := state.Get("config").(*Config)
-	fmt.Println(config)
 
 	var auth []ssh.AuthMethod
 
-	if config.Comm.SSHPrivateKey != "" {
-		privateKey, err := ioutil.ReadFile(config.Comm.SSHPrivateKey)
-		if err != nil {
-			return nil, fmt.Errorf("Error loading configured private key file: %s", err)
-		}
+	if conn, ok := state.GetOk("ssh_agent_conn"); ok {
+		auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn.(net.Conn)).Signers))
+	}
 
-		signer, err := ssh.ParsePrivateKey(privateKey)
+	if config.Comm.SSHPrivateKey != "" {
+		signer, err := sshSigner(config.Comm.SSHPrivateKey, config.SSHPrivateKeyPassphrase, config.SSHCertificateFile)
 		if err != nil {
-			return nil, fmt.Errorf("Error setting up SSH config: %s", err)
+			return nil, err
 		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
 
-		auth = []ssh.AuthMethod{ssh.PublicKeys(signer)}
-	} else {
-		auth = []ssh.AuthMethod{
+	if config.Comm.SSHPassword != "" || len(auth) == 0 {
+		auth = append(auth,
 			ssh.Password(config.Comm.SSHPassword),
 			ssh.KeyboardInteractive(
 				packerssh.PasswordKeyboardInteractive(config.Comm.SSHPassword)),
-		}
+		)
+	}
+
+	hostKeyCallback, err := sshHostKeyCallback(state)
+	if err != nil {
+		return nil, err
 	}
 
 	clientConfig := &ssh.ClientConfig{
 		User:            config.Comm.SSHUsername,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: hostKeyCallback,
 	}
 	clientConfig.Auth = auth
 
 	return clientConfig, nil
 }
+
+// sshSigner loads a private key, optionally protected by a passphrase and
+// combined with an OpenSSH user certificate
+func sshSigner(keyFile string, passphrase string, certFile string) (ssh.Signer, error) {
+	privateKey, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading configured private key file: %s", err)
+	}
+
+	var signer ssh.Signer
+	if passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(privateKey, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(privateKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error setting up SSH config: %s", err)
+	}
+
+	if certFile == "" {
+		return signer, nil
+	}
+
+	certData, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading configured certificate file: %s", err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(certData)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing certificate file: %s", err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("'%v' is not an SSH certificate", certFile)
+	}
+
+	return ssh.NewCertSigner(cert, signer)
+}
+
+// sshHostKeyCallback builds the host key verification for the configured pinning mode
+func sshHostKeyCallback(state multistep.StateBag) (ssh.HostKeyCallback, error) {
+	config := state.Get("config").(*Config)
+
+	if config.SSHHostKeyFingerprint != "" {
+		expected := config.SSHHostKeyFingerprint
+		fingerprint := ssh.FingerprintSHA256
+		if !strings.HasPrefix(expected, "SHA256:") {
+			expected = strings.TrimPrefix(strings.ToLower(expected), "md5:")
+			fingerprint = ssh.FingerprintLegacyMD5
+		}
+
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			actual := fingerprint(key)
+			if actual != expected {
+				return fmt.Errorf("SSH host key fingerprint mismatch: expected %v, got %v", config.SSHHostKeyFingerprint, actual)
+			}
+			return nil
+		}, nil
+	}
+
+	if config.SSHHostKeyGuestFile != "" {
+		d := state.Get("driver").(*Driver)
+		vm := state.Get("vm").(*object.VirtualMachine)
+
+		// VMware Tools or the key may not be ready yet; the error makes the communicator retry
+		data, err := d.ReadGuestFile(vm, config.Comm.SSHUsername, config.Comm.SSHPassword, config.SSHHostKeyGuestFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading SSH host key '%v' from the guest: %s", config.SSHHostKeyGuestFile, err)
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing SSH host key '%v': %s", config.SSHHostKeyGuestFile, err)
+		}
+		return ssh.FixedHostKey(key), nil
+	}
+
+	log.Printf("[WARN] SSH host key verification is disabled")
+	return ssh.InsecureIgnoreHostKey(), nil
+}
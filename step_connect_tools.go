@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/hashicorp/packer/packer"
+	"github.com/mitchellh/multistep"
+	"github.com/vmware/govmomi/object"
+)
+
+// StepConnectTools defines the vmware-tools communicator connection step
+type StepConnectTools struct {
+	config *ToolsConfig
+}
+
+// Run sets up the communicator backed by the guest operations API
+func (s *StepConnectTools) Run(state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	d := state.Get("driver").(*Driver)
+	vm := state.Get("vm").(*object.VirtualMachine)
+
+	ui.Say("Connecting to VM via VMware Tools...")
+
+	comm, err := NewToolsCommunicator(d, vm, s.config)
+	if err != nil {
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+	state.Put("communicator", comm)
+
+	return multistep.ActionContinue
+}
+
+// Cleanup the vmware-tools connection process
+func (s *StepConnectTools) Cleanup(multistep.StateBag) {}
@@ -5,29 +5,62 @@ import (
 	"github.com/hashicorp/packer/packer"
 	"github.com/mitchellh/multistep"
 	"github.com/vmware/govmomi/object"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// bytesRegexp matches a number with an optional unit: B, or K to E followed by B or iB
+var bytesRegexp = regexp.MustCompile(`^(?i)(\d+)\s*(?:([KMGTPE])(?:ib|b)?|(b))?$`)
+
+// Policies of vm_name_collision
+const (
+	vmNameFail            = "fail"
+	vmNameOverwrite       = "overwrite"
+	vmNameAppendTimestamp = "append_timestamp"
 )
 
 // CreateConfig holds all the details for the VM creation process.
 type CreateConfig struct {
 	VMName          string `mapstructure:"vm_name"`
+	VMNameCollision string `mapstructure:"vm_name_collision"`
+	Force           bool   `mapstructure:"force"`
 	Folder          string `mapstructure:"folder"`
+	CreateFolder    bool   `mapstructure:"create_folder"`
 	GuestOS         string `mapstructure:"guest_os_type"`
-	CPU             int32  `mapstructure:"cpu"`
-	RAM             int64  `mapstructure:"ram"`
 	Annotation      string `mapstructure:"annotation"`
 	HardwareVersion string `mapstructure:"hardware_version"`
 
-	Disk         string `mapstructure:"disk_size"`
-	IsoFile      string `mapstructure:"iso"`
-	IsoDatastore string `mapstructure:"iso_datastore"`
-	Host         string `mapstructure:"host"`
-	ResourcePool string `mapstructure:"resource_pool"`
-	Cluster      string `mapstructure:"cluster"`
-	Datastore    string `mapstructure:"datastore"`
+	Disk               string `mapstructure:"disk_size"`
+	DiskControllerType string `mapstructure:"disk_controller_type"`
+	IsoFile            string `mapstructure:"iso"`
+	IsoDatastore       string `mapstructure:"iso_datastore"`
+	CdromType          string `mapstructure:"cdrom_type"`
+	Firmware           string `mapstructure:"firmware"`
+	Host               string `mapstructure:"host"`
+	ResourcePool       string `mapstructure:"resource_pool"`
+	Cluster            string `mapstructure:"cluster"`
+	Datastore          string `mapstructure:"datastore"`
+	DatastoreCluster   string `mapstructure:"datastore_cluster"`
+
+	DatastoreSelection string `mapstructure:"datastore_selection"`
+	DatastoreNameRegex string `mapstructure:"datastore_name_regex"`
+	DatastoreTag       string `mapstructure:"datastore_tag"`
+
+	StoragePolicy     string `mapstructure:"storage_policy"`
+	DiskStoragePolicy string `mapstructure:"disk_storage_policy"`
 
 	Network           string `mapstructure:"network"`
 	NetworkAdapter    string `mapstructure:"network_adapter"`
 	NetworkMacAddress string `mapstructure:"network_mac_address"`
+
+	GuestInfoConfig     `mapstructure:",squash"`
+	TemporaryPoolConfig `mapstructure:",squash"`
+
+	diskBytes           int64
+	datastoreNameRegexp *regexp.Regexp
+	storagePolicyID     string
+	diskStoragePolicyID string
 }
 
 // Prepare the VM creation process
@@ -38,12 +71,133 @@ func (c *CreateConfig) Prepare() []error {
 		errs = append(errs, fmt.Errorf("Target VM name is required"))
 	}
 
+	if c.Force {
+		if c.VMNameCollision != "" && c.VMNameCollision != vmNameOverwrite {
+			errs = append(errs, fmt.Errorf("'force' cannot be used together with 'vm_name_collision' '%v'", c.VMNameCollision))
+		}
+		c.VMNameCollision = vmNameOverwrite
+	}
+	if c.VMNameCollision == "" {
+		c.VMNameCollision = vmNameFail
+	}
+	if c.VMNameCollision != vmNameFail && c.VMNameCollision != vmNameOverwrite && c.VMNameCollision != vmNameAppendTimestamp {
+		errs = append(errs, fmt.Errorf("'vm_name_collision' must be '%v', '%v' or '%v', got '%v'", vmNameFail, vmNameOverwrite, vmNameAppendTimestamp, c.VMNameCollision))
+	}
+
+	if folder, err := normalizeFolder(c.Folder); err != nil {
+		errs = append(errs, err)
+	} else {
+		c.Folder = folder
+	}
+
+	if c.Disk == "" {
+		errs = append(errs, fmt.Errorf("'disk_size' is required"))
+	} else if size, err := parseDiskSize(c.Disk); err != nil {
+		errs = append(errs, err)
+	} else {
+		c.diskBytes = size
+	}
+
+	if c.IsoFile == "" {
+		errs = append(errs, fmt.Errorf("'iso' is required"))
+	}
+	if c.IsoDatastore == "" {
+		errs = append(errs, fmt.Errorf("'iso_datastore' is required"))
+	}
+
+	if c.Datastore != "" && c.DatastoreCluster != "" {
+		errs = append(errs, fmt.Errorf("'datastore' and 'datastore_cluster' cannot be used together"))
+	}
+
+	if c.DatastoreTag != "" {
+		// The tagging API is a separate REST service that govmomi v0.18.0 has no client for
+		errs = append(errs, fmt.Errorf("'datastore_tag' is not supported: filtering datastores by vSphere tag requires the tagging API, which the vendored govmomi does not provide"))
+	}
+	if c.DatastoreSelection == "" && c.DatastoreNameRegex != "" {
+		c.DatastoreSelection = datastoreMostFreeSpace
+	}
+	if c.Datastore == "" && c.DatastoreCluster == "" && c.DatastoreSelection == "" {
+		errs = append(errs, fmt.Errorf("'datastore' is required, unless 'datastore_cluster' or 'datastore_selection' is set"))
+	}
+	if c.DatastoreSelection != "" {
+		if c.DatastoreSelection != datastoreMostFreeSpace && c.DatastoreSelection != datastoreLeastProvisioned {
+			errs = append(errs, fmt.Errorf("'datastore_selection' must be '%v' or '%v', got '%v'", datastoreMostFreeSpace, datastoreLeastProvisioned, c.DatastoreSelection))
+		}
+		if c.Datastore != "" || c.DatastoreCluster != "" {
+			errs = append(errs, fmt.Errorf("'datastore_selection' cannot be used together with 'datastore' or 'datastore_cluster'"))
+		}
+	}
+	if c.DatastoreNameRegex != "" {
+		re, err := regexp.Compile(c.DatastoreNameRegex)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Invalid 'datastore_name_regex': %s", err))
+		} else {
+			c.datastoreNameRegexp = re
+		}
+	}
+
+	if c.DiskControllerType != "" && !isSCSIControllerType(c.DiskControllerType) {
+		errs = append(errs, fmt.Errorf("'disk_controller_type' must be one of %v, got '%v'", strings.Join(scsiControllerTypes(), ", "), c.DiskControllerType))
+	}
+	if c.CdromType != "" && c.CdromType != "ide" && c.CdromType != "sata" {
+		errs = append(errs, fmt.Errorf("'cdrom_type' must be 'ide' or 'sata', got '%v'", c.CdromType))
+	}
+	if c.Firmware != "" && c.Firmware != "bios" && c.Firmware != "efi" {
+		errs = append(errs, fmt.Errorf("'firmware' must be 'bios' or 'efi', got '%v'", c.Firmware))
+	}
+
+	if c.Network == "" {
+		errs = append(errs, fmt.Errorf("'network' is required"))
+	}
+	if c.NetworkAdapter != "" && !isEthernetCardType(c.NetworkAdapter) {
+		errs = append(errs, fmt.Errorf("'network_adapter' must be one of %v, got '%v'", strings.Join(ethernetCardTypes(), ", "), c.NetworkAdapter))
+	}
+
+	errs = append(errs, c.GuestInfoConfig.Prepare()...)
+	errs = append(errs, c.TemporaryPoolConfig.Prepare()...)
+
 	return errs
 }
 
+// parseDiskSize converts a disk size such as "40GB", "512MiB" or "1T" into bytes.
+// Units are powers of 1024, a number without a unit is in GiB.
+func parseDiskSize(size string) (int64, error) {
+	m := bytesRegexp.FindStringSubmatch(strings.TrimSpace(size))
+	if m == nil {
+		return 0, fmt.Errorf("Invalid 'disk_size' '%v', expected a number with an optional unit (B, KB, MB, GB, TB, PB, EB)", size)
+	}
+
+	value, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid 'disk_size' '%v': %s", size, err)
+	}
+
+	unit := strings.ToUpper(m[2])
+	if unit == "" && m[3] == "" {
+		unit = "G"
+	}
+	for i := strings.Index("BKMGTPE", unit); i > 0; i-- {
+		if value > (1<<63-1)/1024 {
+			return 0, fmt.Errorf("Invalid 'disk_size' '%v': value is too large", size)
+		}
+		value *= 1024
+	}
+
+	if value < 1024 {
+		return 0, fmt.Errorf("Invalid 'disk_size' '%v': disks must be at least 1KB", size)
+	}
+	// Disk capacities are set in KB
+	if value%1024 != 0 {
+		return 0, fmt.Errorf("Invalid 'disk_size' '%v': disks must be a whole number of KB", size)
+	}
+	return value, nil
+}
+
 // StepCreateVM defines the creation step
 type StepCreateVM struct {
-	config *CreateConfig
+	config       *CreateConfig
+	hardware     *HardwareConfig
+	configParams map[string]string
 }
 
 // Run creates the VM
@@ -51,15 +205,56 @@ func (s *StepCreateVM) Run(state multistep.StateBag) multistep.StepAction {
 	ui := state.Get("ui").(packer.Ui)
 	d := state.Get("driver").(*Driver)
 
+	if s.config.VMNameCollision == vmNameOverwrite {
+		existing, err := d.FindVM(s.config)
+		if err != nil {
+			state.Put("error", err)
+			return multistep.ActionHalt
+		}
+		if existing != nil {
+			// Checked again right before destroying: the VM may have changed since the preflight checks
+			owned, err := d.CreatedByBuilder(existing)
+			if err != nil {
+				state.Put("error", err)
+				return multistep.ActionHalt
+			}
+			if !owned {
+				state.Put("error", fmt.Errorf("VM '%v' has no '%v' marker of this builder, refusing to destroy it", existing.InventoryPath, builderMarkerKey))
+				return multistep.ActionHalt
+			}
+
+			ui.Say("Destroying existing VM...")
+			err = d.PowerOff(existing)
+			if err == nil {
+				err = d.DestroyVM(existing)
+			}
+			if err != nil {
+				state.Put("error", fmt.Errorf("Error destroying existing VM '%v': %s", s.config.VMName, err))
+				return multistep.ActionHalt
+			}
+		}
+	}
+
 	ui.Say("Creating VM...")
 
-	vm, err := d.CreateVM(s.config)
+	vm, err := d.CreateVM(s.config, s.hardware, s.configParams)
 	if err != nil {
 		state.Put("error", err)
 		return multistep.ActionHalt
 	}
 
 	state.Put("vm", vm)
+
+	datastore, err := d.VMDatastore(vm)
+	if err != nil {
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+	if s.config.DatastoreCluster != "" {
+		ui.Message(fmt.Sprintf("Storage DRS placed the VM on datastore '%v'", datastore))
+	}
+	state.Put("datastore", datastore)
+
 	return multistep.ActionContinue
 }
 
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashicorp/packer/packer"
+	"github.com/mitchellh/multistep"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+	"sort"
+)
+
+// ConfigParamsConfig holds the advanced VMX settings of the VM.
+type ConfigParamsConfig struct {
+	ConfigParams       map[string]string `mapstructure:"configuration_parameters"`
+	RemoveConfigParams []string          `mapstructure:"remove_configuration_parameters"`
+}
+
+// Prepare the advanced settings
+func (c *ConfigParamsConfig) Prepare() []error {
+	var errs []error
+
+	// The builder marker identifies the VMs 'force' may overwrite
+	for key := range c.ConfigParams {
+		if key == "" {
+			errs = append(errs, fmt.Errorf("'configuration_parameters' cannot contain an empty key"))
+		}
+		if key == builderMarkerKey {
+			errs = append(errs, fmt.Errorf("'configuration_parameters' cannot set '%v', it is set by the builder", builderMarkerKey))
+		}
+	}
+	for _, key := range c.RemoveConfigParams {
+		if key == "" {
+			errs = append(errs, fmt.Errorf("'remove_configuration_parameters' cannot contain an empty key"))
+		}
+		if key == builderMarkerKey {
+			errs = append(errs, fmt.Errorf("'remove_configuration_parameters' cannot remove '%v', it is set by the builder", builderMarkerKey))
+		}
+	}
+
+	return errs
+}
+
+// optionValues converts the advanced settings into ExtraConfig entries in a stable order
+func optionValues(params map[string]string) []types.BaseOptionValue {
+	var keys []string
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var opts []types.BaseOptionValue
+	for _, key := range keys {
+		opts = append(opts, &types.OptionValue{Key: key, Value: params[key]})
+	}
+	return opts
+}
+
+// StepRemoveExtraConfig stores the advanced settings to remove from the finished VM
+type StepRemoveExtraConfig struct {
+	keys []string
+}
+
+// Run removes the advanced settings, e.g. injected guestinfo data
+func (s *StepRemoveExtraConfig) Run(state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	d := state.Get("driver").(*Driver)
+	vm := state.Get("vm").(*object.VirtualMachine)
+
+	if len(s.keys) > 0 {
+		ui.Say("Removing advanced settings...")
+
+		err := d.RemoveExtraConfig(vm, s.keys)
+		if err != nil {
+			state.Put("error", err)
+			return multistep.ActionHalt
+		}
+	}
+
+	return multistep.ActionContinue
+}
+
+// Cleanup the advanced settings removal process
+func (s *StepRemoveExtraConfig) Cleanup(multistep.StateBag) {}
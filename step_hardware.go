@@ -5,32 +5,138 @@ import (
 	"github.com/hashicorp/packer/packer"
 	"github.com/mitchellh/multistep"
 	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/vim25/types"
+	"sort"
+	"strconv"
 )
 
-// HardwareConfig stores all the details for post creation hardware configuration.
+// HardwareConfig stores all the details for the VM hardware configuration.
 type HardwareConfig struct {
-	CPUs           int32 `mapstructure:"CPUs"`
-	CPUReservation int64 `mapstructure:"CPU_reservation"`
-	CPULimit       int64 `mapstructure:"CPU_limit"`
-	RAM            int64 `mapstructure:"RAM"`
-	RAMReservation int64 `mapstructure:"RAM_reservation"`
-	RAMReserveAll  bool  `mapstructure:"RAM_reserve_all"`
+	CPUs           int32  `mapstructure:"cpus"`
+	CPUCores       int32  `mapstructure:"cpu_cores"`
+	CPUReservation int64  `mapstructure:"cpu_reservation"`
+	CPULimit       int64  `mapstructure:"cpu_limit"`
+	CPUShares      string `mapstructure:"cpu_shares"`
+	CPUHotPlug     *bool  `mapstructure:"cpu_hot_plug"`
+	RAM            int64  `mapstructure:"ram"`
+	RAMReservation int64  `mapstructure:"ram_reservation"`
+	RAMReserveAll  bool   `mapstructure:"ram_reserve_all"`
+	RAMShares      string `mapstructure:"ram_shares"`
+	RAMHotPlug     *bool  `mapstructure:"ram_hot_plug"`
+	NestedHV       *bool  `mapstructure:"nested_hv"`
+	VPMCEnabled    *bool  `mapstructure:"vpmc_enabled"`
+}
+
+// legacyHardwareKeys maps the keys of the former CreateConfig and HardwareConfig schemas to the current ones
+var legacyHardwareKeys = map[string]string{
+	"cpu":             "cpus",
+	"CPUs":            "cpus",
+	"CPU_reservation": "cpu_reservation",
+	"CPU_limit":       "cpu_limit",
+	"RAM":             "ram",
+	"RAM_reservation": "ram_reservation",
+	"RAM_reserve_all": "ram_reserve_all",
+}
+
+// migrateLegacyHardwareKeys renames legacy hardware keys in the raw configs,
+// warning about each one, and fails when a legacy and a current key disagree
+func migrateLegacyHardwareKeys(raws []interface{}) ([]interface{}, []string, []error) {
+	var warnings []string
+	var errs []error
+
+	result := make([]interface{}, len(raws))
+	for i, raw := range raws {
+		result[i] = raw
+
+		m, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		migrated := make(map[string]interface{}, len(m))
+		for key, value := range m {
+			migrated[key] = value
+		}
+
+		for legacy, current := range legacyHardwareKeys {
+			value, ok := m[legacy]
+			if !ok {
+				continue
+			}
+			delete(migrated, legacy)
+
+			if existing, ok := migrated[current]; ok {
+				if fmt.Sprint(existing) != fmt.Sprint(value) {
+					errs = append(errs, fmt.Errorf("'%v' and '%v' are both set with different values", legacy, current))
+				}
+				continue
+			}
+			migrated[current] = value
+			warnings = append(warnings, fmt.Sprintf("'%v' is deprecated, use '%v' instead", legacy, current))
+		}
+
+		result[i] = migrated
+	}
+
+	sort.Strings(warnings)
+	return result, warnings, errs
 }
 
 // Prepare for the hardware configuration process
 func (c *HardwareConfig) Prepare() []error {
 	var errs []error
 
+	if c.CPUs < 0 {
+		errs = append(errs, fmt.Errorf("'cpus' must be a positive number"))
+	}
+	if c.RAM < 0 {
+		errs = append(errs, fmt.Errorf("'ram' must be a positive number"))
+	}
 	if c.RAMReservation > 0 && c.RAMReserveAll != false {
-		errs = append(errs, fmt.Errorf("'RAM_reservation' and 'RAM_reserve_all' cannot be used together"))
+		errs = append(errs, fmt.Errorf("'ram_reservation' and 'ram_reserve_all' cannot be used together"))
+	}
+	if c.CPUCores < 0 {
+		errs = append(errs, fmt.Errorf("'cpu_cores' must be a positive number"))
+	}
+	if c.CPUCores > 0 && c.CPUs == 0 {
+		errs = append(errs, fmt.Errorf("'cpu_cores' requires the number of CPU sockets in 'cpus'"))
+	}
+	if _, err := parseShares(c.CPUShares); err != nil {
+		errs = append(errs, fmt.Errorf("Invalid 'cpu_shares': %s", err))
+	}
+	if _, err := parseShares(c.RAMShares); err != nil {
+		errs = append(errs, fmt.Errorf("Invalid 'ram_shares': %s", err))
 	}
 
 	return errs
 }
 
+// isTrue reports whether an optional flag is set to true
+func isTrue(flag *bool) bool {
+	return flag != nil && *flag
+}
+
+// parseShares converts a shares level (low, normal, high) or a custom number of shares
+func parseShares(value string) (*types.SharesInfo, error) {
+	switch value {
+	case "":
+		return nil, nil
+	case string(types.SharesLevelLow), string(types.SharesLevelNormal), string(types.SharesLevelHigh):
+		return &types.SharesInfo{Level: types.SharesLevel(value)}, nil
+	}
+
+	shares, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || shares <= 0 {
+		return nil, fmt.Errorf("expected 'low', 'normal', 'high' or a positive number, got '%v'", value)
+	}
+	return &types.SharesInfo{Level: types.SharesLevelCustom, Shares: int32(shares)}, nil
+}
+
 // StepConfigureHardware defines the hardware configuration step
 type StepConfigureHardware struct {
-	config *HardwareConfig
+	config       *HardwareConfig
+	configParams map[string]string
+	createConfig *CreateConfig
 }
 
 // Run configures the VM hardware
@@ -39,10 +145,10 @@ func (s *StepConfigureHardware) Run(state multistep.StateBag) multistep.StepActi
 	d := state.Get("driver").(*Driver)
 	vm := state.Get("vm").(*object.VirtualMachine)
 
-	if *s.config != (HardwareConfig{}) {
+	if *s.config != (HardwareConfig{}) || len(s.configParams) > 0 {
 		ui.Say("Customizing hardware parameters...")
 
-		err := d.ConfigureVM(vm, s.config)
+		err := d.ConfigureVM(vm, s.config, s.configParams, s.createConfig)
 		if err != nil {
 			state.Put("error", err)
 			return multistep.ActionHalt
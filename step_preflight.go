@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashicorp/packer/packer"
+	"github.com/mitchellh/multistep"
+)
+
+// StepPreflight defines the pre-flight inventory check step
+type StepPreflight struct {
+	config *CreateConfig
+}
+
+// Run checks that everything the VM creation depends on exists
+func (s *StepPreflight) Run(state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	d := state.Get("driver").(*Driver)
+
+	ui.Say("Running pre-flight checks...")
+
+	var errs []error
+	if s.config.DatastoreSelection != "" {
+		datastore, err := d.SelectDatastore(s.config)
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			s.config.Datastore = datastore
+			ui.Message(fmt.Sprintf("Selected datastore '%v'", datastore))
+		}
+	}
+
+	vmName := s.config.VMName
+	errs = append(errs, d.Preflight(s.config)...)
+	if s.config.VMName != vmName {
+		ui.Message(fmt.Sprintf("VM '%v' already exists, using name '%v'", vmName, s.config.VMName))
+	}
+
+	hardwareVersion := s.config.HardwareVersion
+	errs = append(errs, d.ValidateGuest(s.config)...)
+	if hardwareVersion == "" && s.config.HardwareVersion != "" {
+		ui.Message(fmt.Sprintf("Using hardware version %v", s.config.HardwareVersion))
+	}
+
+	if s.config.StoragePolicy != "" || s.config.DiskStoragePolicy != "" {
+		errs = append(errs, d.ValidateStoragePolicies(s.config)...)
+	}
+
+	if len(errs) > 0 {
+		state.Put("error", &packer.MultiError{Errors: errs})
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+// Cleanup the pre-flight check process
+func (s *StepPreflight) Cleanup(multistep.StateBag) {}
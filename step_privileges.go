@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashicorp/packer/packer"
+	"github.com/mitchellh/multistep"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// StepCheckPrivileges defines the privilege pre-check step
+type StepCheckPrivileges struct {
+	config *Config
+}
+
+// Run verifies that the vSphere account holds the privileges needed for the configured build
+func (s *StepCheckPrivileges) Run(state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packer.Ui)
+	d := state.Get("driver").(*Driver)
+
+	ui.Say("Checking privileges...")
+
+	missing, err := d.CheckPrivileges(&s.config.CreateConfig, requiredVMPrivileges(s.config))
+	if err != nil {
+		// e.g. vCenter versions without HasPrivilegeOnEntities
+		if isNotSupported(err) {
+			ui.Message(fmt.Sprintf("Cannot verify privileges, continuing: %s", err))
+			return multistep.ActionContinue
+		}
+		state.Put("error", fmt.Errorf("Error checking privileges: %s", err))
+		return multistep.ActionHalt
+	}
+	if len(missing) > 0 {
+		state.Put("error", &packer.MultiError{Errors: missing})
+		return multistep.ActionHalt
+	}
+
+	return multistep.ActionContinue
+}
+
+// Cleanup the privilege check process
+func (s *StepCheckPrivileges) Cleanup(multistep.StateBag) {}
+
+// isNotSupported reports whether vCenter does not implement the privilege check
+func isNotSupported(err error) bool {
+	if !soap.IsSoapFault(err) {
+		return false
+	}
+	switch soap.ToSoapFault(err).VimFault().(type) {
+	case types.MethodNotFound, types.NotSupported:
+		return true
+	}
+	return false
+}
+
+// requiredVMPrivileges returns the privileges needed on the VM for the configured features
+func requiredVMPrivileges(config *Config) []string {
+	privileges := []string{
+		"VirtualMachine.Config.AddNewDisk",
+		"VirtualMachine.Config.AddRemoveDevice",
+		"VirtualMachine.Interact.PowerOff",
+	}
+
+	if config.HardwareConfig != (HardwareConfig{}) {
+		privileges = append(privileges,
+			"VirtualMachine.Config.CPUCount",
+			"VirtualMachine.Config.Memory",
+			"VirtualMachine.Config.Resource",
+		)
+	}
+	if len(config.ConfigParams) > 0 || len(config.RemoveConfigParams) > 0 || len(config.GuestInfoConfig.Keys()) > 0 {
+		privileges = append(privileges, "VirtualMachine.Config.AdvancedConfig")
+	}
+	if config.Comm.Type != "none" {
+		privileges = append(privileges, "VirtualMachine.Interact.PowerOn")
+	}
+	if config.Comm.Type == "vmware-tools" {
+		privileges = append(privileges,
+			"VirtualMachine.GuestOperations.Execute",
+			"VirtualMachine.GuestOperations.Modify",
+			"VirtualMachine.GuestOperations.Query",
+		)
+	}
+	if config.Comm.Type == "ssh" && config.SSHHostKeyGuestFile != "" {
+		privileges = append(privileges, "VirtualMachine.GuestOperations.Query")
+	}
+	if config.StoragePolicy != "" || config.DiskStoragePolicy != "" {
+		privileges = append(privileges, "StorageProfile.View")
+	}
+	if config.CreateSnapshot {
+		privileges = append(privileges, "VirtualMachine.State.CreateSnapshot")
+	}
+	if config.ConvertToTemplate {
+		privileges = append(privileges, "VirtualMachine.Provisioning.MarkAsTemplate")
+	}
+
+	return privileges
+}
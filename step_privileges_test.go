@@ -0,0 +1,17 @@
+package main
+
+import "testing"
+
+func TestRequiredVMPrivileges(t *testing.T) {
+	raw := minimalConfig()
+	raw["storage_policy"] = "gold"
+	conf, warns, err := NewConfig(raw)
+	testConfigOk(t, warns, err)
+	if err != nil {
+		return
+	}
+
+	if !containsString(requiredVMPrivileges(conf), "StorageProfile.View") {
+		t.Errorf("'storage_policy' requires StorageProfile.View")
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/packer/packer"
+	"github.com/mitchellh/multistep"
+	"github.com/vmware/govmomi/object"
+)
+
+// TemporaryPoolConfig holds the details of the resource pool created for the duration of the build.
+type TemporaryPoolConfig struct {
+	TemporaryPool         bool  `mapstructure:"temporary_resource_pool"`
+	TemporaryPoolCPULimit int64 `mapstructure:"temporary_resource_pool_cpu_limit"`
+	TemporaryPoolRAMLimit int64 `mapstructure:"temporary_resource_pool_ram_limit"`
+}
+
+// Prepare the temporary resource pool configuration
+func (c *TemporaryPoolConfig) Prepare() []error {
+	var errs []error
+
+	if c.TemporaryPoolCPULimit < 0 {
+		errs = append(errs, fmt.Errorf("'temporary_resource_pool_cpu_limit' must be a positive number"))
+	}
+	if c.TemporaryPoolRAMLimit < 0 {
+		errs = append(errs, fmt.Errorf("'temporary_resource_pool_ram_limit' must be a positive number"))
+	}
+	if !c.TemporaryPool && (c.TemporaryPoolCPULimit != 0 || c.TemporaryPoolRAMLimit != 0) {
+		errs = append(errs, fmt.Errorf("'temporary_resource_pool_cpu_limit' and 'temporary_resource_pool_ram_limit' require 'temporary_resource_pool'"))
+	}
+
+	return errs
+}
+
+// StepCreateResourcePool defines the temporary resource pool step
+type StepCreateResourcePool struct {
+	config *CreateConfig
+}
+
+// Run creates a child of the target resource pool the VM is created in
+func (s *StepCreateResourcePool) Run(state multistep.StateBag) multistep.StepAction {
+	if !s.config.TemporaryPool {
+		return multistep.ActionContinue
+	}
+
+	ui := state.Get("ui").(packer.Ui)
+	d := state.Get("driver").(*Driver)
+
+	ui.Say("Creating temporary resource pool...")
+
+	name := fmt.Sprintf("packer-%v-%v", s.config.VMName, time.Now().Unix())
+	pool, err := d.CreateResourcePool(s.config.ResourcePool, name, s.config.TemporaryPoolCPULimit, s.config.TemporaryPoolRAMLimit)
+	if err != nil {
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+	ui.Message(fmt.Sprintf("Created resource pool '%v'", pool.InventoryPath))
+
+	// The VM is created in the temporary pool instead of resource_pool
+	d.ResourcePool = pool
+	state.Put("temporary_resource_pool", pool)
+
+	return multistep.ActionContinue
+}
+
+// Cleanup moves the VM to its final resource pool and deletes the temporary pool
+func (s *StepCreateResourcePool) Cleanup(state multistep.StateBag) {
+	pool, ok := state.GetOk("temporary_resource_pool")
+	if !ok {
+		return
+	}
+
+	ui := state.Get("ui").(packer.Ui)
+	d := state.Get("driver").(*Driver)
+	d.ResourcePool = nil
+
+	// Templates and VMs destroyed on failure are not in the pool anymore
+	if vm, ok := state.GetOk("vm"); ok {
+		err := d.MoveToResourcePool(vm.(*object.VirtualMachine), s.config.ResourcePool)
+		if err != nil {
+			ui.Error(err.Error())
+		}
+	}
+
+	ui.Say("Deleting temporary resource pool...")
+	err := d.DestroyResourcePool(pool.(*object.ResourcePool))
+	if err != nil {
+		ui.Error(err.Error())
+	}
+}
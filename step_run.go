@@ -9,6 +9,8 @@ import (
 
 // StepRun stores the configuration for the run process
 type StepRun struct {
+	// Wait for VMware Tools instead of an IP address when the guest is not reachable over the network
+	toolsOnly bool
 }
 
 // Run powers on the VM and waits for the IP address
@@ -24,6 +26,16 @@ func (s *StepRun) Run(state multistep.StateBag) multistep.StepAction {
 		return multistep.ActionHalt
 	}
 
+	if s.toolsOnly {
+		ui.Say("Waiting for VMware Tools...")
+		err = d.WaitForTools(vm)
+		if err != nil {
+			state.Put("error", err)
+			return multistep.ActionHalt
+		}
+		return multistep.ActionContinue
+	}
+
 	ui.Say("Waiting for IP...")
 	ip, err := d.WaitForIP(vm)
 	if err != nil {
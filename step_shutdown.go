@@ -9,8 +9,28 @@ import (
 	"time"
 )
 
+// ShutdownConfig holds the details of the guest shutdown.
+type ShutdownConfig struct {
+	Timeout time.Duration `mapstructure:"shutdown_timeout"`
+}
+
+// Prepare the guest shutdown configuration
+func (c *ShutdownConfig) Prepare() []error {
+	var errs []error
+
+	if c.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("'shutdown_timeout' must be a positive duration"))
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 5 * time.Minute
+	}
+
+	return errs
+}
+
 // StepShutdown holds the configuration for the shutdown step
 type StepShutdown struct {
+	config *ShutdownConfig
 }
 
 // Run the shutdown process
@@ -27,9 +47,8 @@ func (s *StepShutdown) Run(state multistep.StateBag) multistep.StepAction {
 		return multistep.ActionHalt
 	}
 
-	timeoutvalue := time.Second * 300
-	log.Printf("Waiting max %s for shutdown to complete", timeoutvalue)
-	err = d.WaitForShutdown(vm, timeoutvalue)
+	log.Printf("Waiting max %s for shutdown to complete", s.config.Timeout)
+	err = d.WaitForShutdown(vm, s.config.Timeout)
 	if err != nil {
 		state.Put("error", err)
 		return multistep.ActionHalt
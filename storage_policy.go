@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/pbm"
+	pbmtypes "github.com/vmware/govmomi/pbm/types"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// pbmClient returns a client of the storage policy (SPBM) API sharing the vCenter session
+func (d *Driver) pbmClient() (*pbm.Client, error) {
+	if d.pbm == nil {
+		c, err := pbm.NewClient(d.ctx, d.client.Client)
+		if err != nil {
+			return nil, err
+		}
+		d.pbm = c
+	}
+	return d.pbm, nil
+}
+
+// ValidateStoragePolicies resolves storage_policy and disk_storage_policy by name
+// and checks that the target datastore is compatible with them
+func (d *Driver) ValidateStoragePolicies(config *CreateConfig) []error {
+	var errs []error
+
+	policies := []struct {
+		key  string
+		name string
+		id   *string
+	}{
+		{"storage_policy", config.StoragePolicy, &config.storagePolicyID},
+		{"disk_storage_policy", config.DiskStoragePolicy, &config.diskStoragePolicyID},
+	}
+
+	var hubs []pbmtypes.PbmPlacementHub
+	for _, policy := range policies {
+		if policy.name == "" {
+			continue
+		}
+
+		id, err := d.storagePolicyID(policy.key, policy.name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		*policy.id = id
+
+		if hubs == nil {
+			hubs, err = d.placementHubs(config)
+			if err != nil {
+				return append(errs, err)
+			}
+		}
+		if err := d.checkStoragePolicy(policy.name, id, hubs); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// storagePolicyID returns the ID of the storage policy with the given name
+func (d *Driver) storagePolicyID(key string, name string) (string, error) {
+	c, err := d.pbmClient()
+	if err != nil {
+		return "", err
+	}
+
+	rtype := pbmtypes.PbmProfileResourceType{ResourceType: string(pbmtypes.PbmProfileResourceTypeEnumSTORAGE)}
+	ids, err := c.QueryProfile(d.ctx, rtype, string(pbmtypes.PbmProfileCategoryEnumREQUIREMENT))
+	if err != nil {
+		return "", err
+	}
+	profiles, err := c.RetrieveContent(d.ctx, ids)
+	if err != nil {
+		return "", err
+	}
+
+	var names []string
+	for _, p := range profiles {
+		profile := p.GetPbmProfile()
+		if profile.Name == name {
+			return profile.ProfileId.UniqueId, nil
+		}
+		names = append(names, profile.Name)
+	}
+	return "", unsupportedValueError(key, name, names)
+}
+
+// placementHubs returns the datastores the VM may be placed on: every datastore
+// of datastore_cluster, or the target datastore
+func (d *Driver) placementHubs(config *CreateConfig) ([]pbmtypes.PbmPlacementHub, error) {
+	var refs []types.ManagedObjectReference
+
+	if config.DatastoreCluster != "" {
+		pod, err := d.finder.DatastoreCluster(d.ctx, config.DatastoreCluster)
+		if err != nil {
+			return nil, err
+		}
+		var sp mo.StoragePod
+		err = pod.Properties(d.ctx, pod.Reference(), []string{"childEntity"}, &sp)
+		if err != nil {
+			return nil, err
+		}
+		refs = sp.ChildEntity
+	} else {
+		datastore, err := d.finder.Datastore(d.ctx, config.Datastore)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, datastore.Reference())
+	}
+
+	var hubs []pbmtypes.PbmPlacementHub
+	for _, ref := range refs {
+		hubs = append(hubs, pbmtypes.PbmPlacementHub{HubType: ref.Type, HubId: ref.Value})
+	}
+	return hubs, nil
+}
+
+// checkStoragePolicy fails when none of the datastores is compatible with the policy
+func (d *Driver) checkStoragePolicy(name string, id string, hubs []pbmtypes.PbmPlacementHub) error {
+	c, err := d.pbmClient()
+	if err != nil {
+		return err
+	}
+
+	req := []pbmtypes.BasePbmPlacementRequirement{
+		&pbmtypes.PbmPlacementCapabilityProfileRequirement{
+			ProfileId: pbmtypes.PbmProfileId{UniqueId: id},
+		},
+	}
+	result, err := c.CheckRequirements(d.ctx, hubs, nil, req)
+	if err != nil {
+		return err
+	}
+	if len(result.CompatibleDatastores()) > 0 {
+		return nil
+	}
+
+	var reasons []string
+	for _, r := range result {
+		for _, fault := range r.Error {
+			reasons = append(reasons, fault.LocalizedMessage)
+		}
+	}
+	if len(reasons) > 0 {
+		return fmt.Errorf("The datastore is not compatible with storage policy '%v': %v", name, strings.Join(reasons, "; "))
+	}
+	return fmt.Errorf("The datastore is not compatible with storage policy '%v'", name)
+}
+
+// profileSpec returns the spec assigning a storage policy, nil when id is empty
+func profileSpec(id string) []types.BaseVirtualMachineProfileSpec {
+	if id == "" {
+		return nil
+	}
+	return []types.BaseVirtualMachineProfileSpec{
+		&types.VirtualMachineDefinedProfileSpec{ProfileId: id},
+	}
+}
+
+// diskPolicyID returns the ID of the disk storage policy. The disk follows the
+// VM storage policy unless it has its own.
+func (c *CreateConfig) diskPolicyID() string {
+	if c.diskStoragePolicyID != "" {
+		return c.diskStoragePolicyID
+	}
+	return c.storagePolicyID
+}
+
+// diskProfileChanges returns the device changes assigning the storage policy to the disks of the VM
+func (d *Driver) diskProfileChanges(vm *object.VirtualMachine, id string) ([]types.BaseVirtualDeviceConfigSpec, error) {
+	if id == "" {
+		return nil, nil
+	}
+
+	devices, err := vm.Device(d.ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []types.BaseVirtualDeviceConfigSpec
+	for _, disk := range devices.SelectByType((*types.VirtualDisk)(nil)) {
+		changes = append(changes, &types.VirtualDeviceConfigSpec{
+			Operation: types.VirtualDeviceConfigSpecOperationEdit,
+			Device:    disk,
+			Profile:   profileSpec(id),
+		})
+	}
+	return changes, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import "sort"
+
+// closestMatches returns up to three candidates that look like a typo of value
+func closestMatches(value string, candidates []string) []string {
+	type match struct {
+		candidate string
+		distance  int
+	}
+
+	maxDistance := len(value)/3 + 1
+	var matches []match
+	for _, c := range candidates {
+		if d := levenshtein(value, c); d <= maxDistance {
+			matches = append(matches, match{c, d})
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].distance < matches[j].distance
+	})
+
+	var result []string
+	for i := 0; i < len(matches) && i < 3; i++ {
+		result = append(result, matches[i].candidate)
+	}
+	return result
+}
+
+// levenshtein computes the edit distance between two strings
+func levenshtein(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, minInt(cur[j-1]+1, prev[j-1]+cost))
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
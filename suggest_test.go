@@ -0,0 +1,19 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClosestMatches(t *testing.T) {
+	candidates := []string{"centos7_64Guest", "centos6_64Guest", "ubuntu64Guest", "windows9Server64Guest"}
+
+	matches := closestMatches("centos7_64guest", candidates)
+	if !reflect.DeepEqual(matches, []string{"centos7_64Guest", "centos6_64Guest"}) {
+		t.Errorf("Unexpected matches: %#v", matches)
+	}
+
+	if matches := closestMatches("freebsd", candidates); len(matches) > 0 {
+		t.Errorf("Expected no matches, got %#v", matches)
+	}
+}